@@ -0,0 +1,40 @@
+package client
+
+import (
+	"log"
+	"net"
+
+	"github.com/muyuballs/go-proxy/core/common"
+	"github.com/muyuballs/go-proxy/core/socks"
+)
+
+// handBind serves a socks BIND request, reply is called once with the
+// listening address and once with the address of the accepted peer.
+func handBind(conf *common.Config, acs *common.ACStream, req *socks.Request, reply func(err error, addr net.Addr) error) {
+	log.Println("bind:", req.Target)
+	b, err := common.Bind(conf, &common.Metadata{Source: acs.RemoteAddr(), User: req.User}, req.Target)
+	if err != nil {
+		log.Println(err)
+		_ = reply(err, nil)
+		return
+	}
+	defer b.Close()
+	if err = reply(nil, b.Addr); err != nil {
+		log.Println(err)
+		return
+	}
+	stop := common.WatchClose(acs, b)
+	rAcs, peer, err := b.Accept()
+	stop()
+	if e := reply(err, peer); e != nil || err != nil {
+		log.Println(err, e)
+		if rAcs != nil {
+			rAcs.Close()
+		}
+		return
+	}
+	log.Println("bind:", b.Addr, "accepted", peer)
+	defer rAcs.Close()
+	go common.Transfer(rAcs.Open(), acs.Open(), "OUT")
+	go common.Transfer(acs.Open(), rAcs.Open(), "IN")
+}
@@ -17,18 +17,17 @@ func handClient(conf *common.Config, conn net.Conn) {
 		return
 	}
 	//http.HandleHttps(acs.Open())
-	var remote string
+	var req *socks.Request
+	var reply func(err error, addr net.Addr) error
 	if v[0] == socks.SocksVer4 {
-		remote, err = socks.HandleSocks4(acs)
-		if err != nil {
-			log.Println(err)
-			return
+		req, err = socks.HandleSocks4(acs)
+		reply = func(err error, addr net.Addr) error {
+			return socks.ReplySocks4(acs, socks.Socks4Reply(err), addr)
 		}
 	} else if v[0] == socks.SocksVer5 {
-		remote, err = socks.HandleSocks5(acs)
-		if err != nil {
-			log.Println(err)
-			return
+		req, err = socks.HandleSocks5(acs)
+		reply = func(err error, addr net.Addr) error {
+			return socks.ReplySocks5(acs, socks.Socks5Rep(err), addr)
 		}
 	} else if conf.HttpEnable && v[0] >= 'A' && v[0] <= 'Z' {
 		err := http.HandleHttp(acs.Open())
@@ -40,13 +39,37 @@ func handClient(conf *common.Config, conn net.Conn) {
 		log.Println("unsupported socks version")
 		return
 	}
-	log.Println("target:", remote)
-	rAcs, err := common.DialRemote(conf, nil, remote)
 	if err != nil {
-		_ = conn.Close()
 		log.Println(err)
 		return
 	}
+	if req.IsUDPAssociate() {
+		handUDPAssociate(conf, acs, req)
+	} else if req.IsBind() {
+		handBind(conf, acs, req, reply)
+	} else {
+		handConnect(conf, acs, req, reply)
+	}
+}
+
+func handConnect(conf *common.Config, acs *common.ACStream, req *socks.Request, reply func(err error, addr net.Addr) error) {
+	if req.User != "" {
+		log.Println("target:", req.Target, "user:", req.User)
+	} else {
+		log.Println("target:", req.Target)
+	}
+	rAcs, err := common.DialRemote(conf, &common.Metadata{Source: acs.RemoteAddr(), User: req.User}, req.Target)
+	var bound net.Addr
+	if err == nil {
+		bound = common.BoundAddr(rAcs)
+	}
+	if e := reply(err, bound); e != nil || err != nil {
+		log.Println(err, e)
+		if rAcs != nil {
+			rAcs.Close()
+		}
+		return
+	}
 	defer rAcs.Close()
 	go common.Transfer(rAcs.Open(), acs.Open(), "OUT")
 	go common.Transfer(acs.Open(), rAcs.Open(), "IN")
@@ -57,11 +80,30 @@ func StartClient(conf *common.Config) error {
 	if err != nil {
 		return err
 	}
+	err = common.LoadGeoIP(conf)
+	if err != nil {
+		return err
+	}
+	err = common.LoadUsers(conf)
+	if err != nil {
+		return err
+	}
+	common.StartHealthCheck(conf)
+	common.StartReverse(conf)
+	err = startForwards(conf)
+	if err != nil {
+		return err
+	}
+	err = startTransparent(conf)
+	if err != nil {
+		return err
+	}
 
 	l, err := net.Listen("tcp", conf.Listen)
 	if err != nil {
 		return err
 	}
+	l = common.WrapProxyProtocol(conf, l)
 	http.InitHandler(conf)
 	defer l.Close()
 	for {
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/muyuballs/go-proxy/core/common"
+)
+
+// Forward is a static local listener whose connections all go to Target,
+// routed by the rules like any socks or http request.
+type Forward struct {
+	Local  string
+	Target string
+	Conns  int64
+	Active int64
+	Errors int64
+	In     int64
+	Out    int64
+	ln     net.Listener
+}
+
+var (
+	forwards = make(map[string]*Forward)
+	fwLock   = &sync.Mutex{}
+)
+
+// ParseForwards parses --forward local=target, a bare port listens on
+// localhost only.
+func ParseForwards(list []string) (map[string]string, error) {
+	fws := make(map[string]string)
+	for _, item := range list {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad forward:%s", item)
+		}
+		local := parts[0]
+		if _, err := strconv.Atoi(local); err == nil {
+			local = "127.0.0.1:" + local
+		}
+		if _, _, err := net.SplitHostPort(local); err != nil {
+			return nil, fmt.Errorf("bad forward local:%s", parts[0])
+		}
+		if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+			return nil, fmt.Errorf("bad forward target:%s", parts[1])
+		}
+		fws[local] = parts[1]
+	}
+	return fws, nil
+}
+
+func startForwards(conf *common.Config) error {
+	for local, target := range conf.Forwards {
+		if err := AddForward(conf, local, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddForward starts forwarding local to target, it can be called while the
+// client is running.
+func AddForward(conf *common.Config, local, target string) error {
+	fwLock.Lock()
+	defer fwLock.Unlock()
+	if _, ok := forwards[local]; ok {
+		return fmt.Errorf("forward exists:%s", local)
+	}
+	ln, err := net.Listen("tcp", local)
+	if err != nil {
+		return err
+	}
+	fw := &Forward{Local: local, Target: target, ln: ln}
+	forwards[local] = fw
+	log.Println("forward", ln.Addr(), "->", target)
+	go fw.serve(conf)
+	return nil
+}
+
+// DelForward stops listening on local, open connections are kept.
+func DelForward(local string) error {
+	fwLock.Lock()
+	fw, ok := forwards[local]
+	delete(forwards, local)
+	fwLock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown forward:%s", local)
+	}
+	return fw.ln.Close()
+}
+
+// ListForwards returns a snapshot of the forwards and their stats.
+func ListForwards() []Forward {
+	fwLock.Lock()
+	defer fwLock.Unlock()
+	list := make([]Forward, 0, len(forwards))
+	for _, fw := range forwards {
+		list = append(list, Forward{
+			Local:  fw.Local,
+			Target: fw.Target,
+			Conns:  atomic.LoadInt64(&fw.Conns),
+			Active: atomic.LoadInt64(&fw.Active),
+			Errors: atomic.LoadInt64(&fw.Errors),
+			In:     atomic.LoadInt64(&fw.In),
+			Out:    atomic.LoadInt64(&fw.Out),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Local < list[j].Local })
+	return list
+}
+
+func PrintForwards() {
+	for _, fw := range ListForwards() {
+		log.Printf("forward %s -> %s conns:%d active:%d errors:%d in:%s out:%s\n", fw.Local, fw.Target,
+			fw.Conns, fw.Active, fw.Errors, common.FormatNS(float64(fw.In)), common.FormatNS(float64(fw.Out)))
+	}
+}
+
+func (fw *Forward) serve(conf *common.Config) {
+	for {
+		conn, err := fw.ln.Accept()
+		if err != nil {
+			log.Println("forward", fw.Local, err)
+			fwLock.Lock()
+			if forwards[fw.Local] == fw {
+				delete(forwards, fw.Local)
+			}
+			fwLock.Unlock()
+			return
+		}
+		atomic.AddInt64(&fw.Conns, 1)
+		go fw.hand(conf, conn)
+	}
+}
+
+func (fw *Forward) hand(conf *common.Config, conn net.Conn) {
+	atomic.AddInt64(&fw.Active, 1)
+	defer atomic.AddInt64(&fw.Active, -1)
+	acs := common.NewACS(&countConn{Conn: conn, in: &fw.In, out: &fw.Out})
+	defer acs.Close()
+	log.Println("forward", fw.Local, "from", conn.RemoteAddr(), "->", fw.Target)
+	rAcs, err := common.DialRemote(conf, &common.Metadata{Source: conn.RemoteAddr()}, fw.Target)
+	if err != nil {
+		log.Println(err)
+		atomic.AddInt64(&fw.Errors, 1)
+		return
+	}
+	defer rAcs.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		common.Transfer(rAcs.Open(), acs.Open(), "OUT")
+		done <- struct{}{}
+	}()
+	go func() {
+		common.Transfer(acs.Open(), rAcs.Open(), "IN")
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// countConn counts the bytes read from and written to the local peer.
+type countConn struct {
+	net.Conn
+	in  *int64
+	out *int64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.out, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.in, int64(n))
+	return n, err
+}
+
+func (c *countConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+func (c *countConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/muyuballs/go-proxy/core/common"
+)
+
+func TestForwardAddDel(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	// find a free local port for the forward
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := ln.Addr().String()
+	ln.Close()
+
+	if err = AddForward(&common.Config{}, local, target.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err = AddForward(&common.Config{}, local, target.Addr().String()); err == nil {
+		t.Error("second forward on the same address was added")
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+	conn.Close()
+	if list := ListForwards(); len(list) != 1 || list[0].Local != local || list[0].Conns != 1 {
+		t.Errorf("ListForwards = %+v", list)
+	}
+
+	if err = DelForward(local); err != nil {
+		t.Fatal(err)
+	}
+	if err = DelForward(local); err == nil {
+		t.Error("removed an unknown forward")
+	}
+	if list := ListForwards(); len(list) != 0 {
+		t.Errorf("forward still listed: %+v", list)
+	}
+	// the port is released
+	ln, err = net.Listen("tcp", local)
+	if err != nil {
+		t.Fatalf("port not released: %v", err)
+	}
+	ln.Close()
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST of netfilter
+const soOriginalDst = 80
+
+// getOriginalDst returns the destination of a connection before it was
+// redirected to us by iptables REDIRECT or DNAT.
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("not a tcp connection")
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// sockaddr_in fits in the 16 bytes of ipv6_mreq.multiaddr
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			sa := mreq.Multiaddr
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+				Port: int(sa[2])<<8 | int(sa[3]),
+			}
+			return
+		}
+		// sockaddr_in6 is the head of ip6_mtuinfo
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		var port [2]byte
+		binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		addr = &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, serr
+}
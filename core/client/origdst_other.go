@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxy needs linux")
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/muyuballs/go-proxy/core/common"
+)
+
+const sniffTimeout = 500 * time.Millisecond
+
+// sniffHost peeks the first bytes of a connection for the tls server name
+// or the http Host header, it gives up on protocols where the server speaks
+// first.
+func sniffHost(acs *common.ACStream) string {
+	acs.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer acs.SetReadDeadline(time.Time{})
+	v, err := acs.Pick(1)
+	if err != nil {
+		return ""
+	}
+	r := acs.Reader()
+	switch {
+	case v[0] == 0x16:
+		head, err := acs.Pick(5)
+		if err != nil {
+			return ""
+		}
+		n := 5 + (int(head[3])<<8 | int(head[4]))
+		if n > r.Size() {
+			n = r.Size()
+		}
+		data, err := acs.Pick(n)
+		if err != nil {
+			data, _ = acs.Pick(r.Buffered())
+		}
+		return parseSNI(data)
+	case v[0] >= 'A' && v[0] <= 'Z':
+		for {
+			data, _ := acs.Pick(r.Buffered())
+			if host, done := parseHTTPHost(data); done {
+				return host
+			}
+			if r.Buffered() >= r.Size() {
+				return ""
+			}
+			if _, err = acs.Pick(r.Buffered() + 1); err != nil {
+				return ""
+			}
+		}
+	}
+	return ""
+}
+
+// parseHTTPHost returns the host of a request head, done is false while the
+// head is incomplete.
+func parseHTTPHost(data []byte) (host string, done bool) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end >= 0 {
+		data = data[:end]
+	}
+	lines := strings.Split(string(data), "\r\n")
+	if end < 0 {
+		// the last line may be cut
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return "", false
+	}
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "Host") {
+			continue
+		}
+		host = strings.TrimSpace(kv[1])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host, true
+	}
+	return "", end >= 0
+}
+
+// parseSNI returns the server name extension of a tls ClientHello record.
+func parseSNI(data []byte) string {
+	// record header, handshake type and length, version and random
+	p := 5 + 4 + 2 + 32
+	if len(data) < p+1 || data[0] != 0x16 || data[5] != 0x01 {
+		return ""
+	}
+	skip := func(lenBytes int) bool {
+		if len(data) < p+lenBytes {
+			return false
+		}
+		n := 0
+		for i := 0; i < lenBytes; i++ {
+			n = n<<8 | int(data[p+i])
+		}
+		p += lenBytes + n
+		return len(data) >= p
+	}
+	// session id, cipher suites, compression methods
+	if !skip(1) || !skip(2) || !skip(1) {
+		return ""
+	}
+	p += 2
+	for len(data) >= p+4 {
+		tpe := int(data[p])<<8 | int(data[p+1])
+		n := int(data[p+2])<<8 | int(data[p+3])
+		p += 4
+		if len(data) < p+n {
+			return ""
+		}
+		if tpe != 0x0000 {
+			p += n
+			continue
+		}
+		ext := data[p : p+n]
+		// server name list length, name type, name length
+		if len(ext) < 5 || ext[2] != 0x00 {
+			return ""
+		}
+		nameLen := int(ext[3])<<8 | int(ext[4])
+		if len(ext) < 5+nameLen {
+			return ""
+		}
+		return string(ext[5 : 5+nameLen])
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/muyuballs/go-proxy/core/common"
+)
+
+// clientHello returns the first tls record crypto/tls sends for name.
+func clientHello(t *testing.T, name string) []byte {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		tls.Client(c1, &tls.Config{ServerName: name}).Handshake()
+		c1.Close()
+	}()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(c2, head); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+(int(head[3])<<8|int(head[4])))
+	copy(record, head)
+	if _, err := io.ReadFull(c2, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// sniLast moves the server name extension of a ClientHello to the end, as
+// browsers that shuffle their extensions may send it.
+func sniLast(t *testing.T, hello []byte) []byte {
+	t.Helper()
+	p := 5 + 4 + 2 + 32
+	p += 1 + int(hello[p])
+	p += 2 + (int(hello[p])<<8 | int(hello[p+1]))
+	p += 1 + int(hello[p])
+	p += 2
+	var sni, rest []byte
+	for p+4 <= len(hello) {
+		n := 4 + (int(hello[p+2])<<8 | int(hello[p+3]))
+		if hello[p] == 0 && hello[p+1] == 0 {
+			sni = hello[p : p+n]
+		} else {
+			rest = append(rest, hello[p:p+n]...)
+		}
+		p += n
+	}
+	if sni == nil || p != len(hello) {
+		t.Fatal("bad client hello")
+	}
+	out := append([]byte{}, hello[:len(hello)-len(sni)-len(rest)]...)
+	return append(append(out, rest...), sni...)
+}
+
+func sniffData(data []byte) string {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		c2.Write(data)
+	}()
+	return sniffHost(common.NewACS(c1))
+}
+
+func TestSniffTLS(t *testing.T) {
+	// a record length with bit 0 or 2 set in its low byte was cut short
+	// when the length was computed without parentheses, losing the end of
+	// the last extension
+	var name string
+	var hello []byte
+	for i := 1; i < 64; i++ {
+		name = strings.Repeat("a", i) + ".example.com"
+		hello = clientHello(t, name)
+		if hello[4]&0x05 != 0 {
+			break
+		}
+	}
+	if hello[4]&0x05 == 0 {
+		t.Fatal("no client hello with bit 0 or 2 set in the length")
+	}
+	if got := sniffData(hello); got != name {
+		t.Errorf("sniffHost = %q, want %q", got, name)
+	}
+	if got := sniffData(sniLast(t, hello)); got != name {
+		t.Errorf("sniffHost = %q, want %q", got, name)
+	}
+}
+
+func TestSniffHTTP(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nHost: www.example.com:8080\r\nAccept: */*\r\n\r\n"
+	if got := sniffData([]byte(req)); got != "www.example.com" {
+		t.Errorf("sniffHost = %q, want www.example.com", got)
+	}
+	if got := sniffData([]byte("SSH-2.0-OpenSSH_9.6\r\n")); got != "" {
+		t.Errorf("sniffHost of ssh = %q", got)
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/muyuballs/go-proxy/core/common"
+)
+
+// originalDst looks up where a redirected connection was going, it is a
+// variable so other lookups can be plugged in.
+var originalDst = getOriginalDst
+
+// startTransparent accepts connections redirected by iptables, e.g.
+// iptables -t nat -A PREROUTING -p tcp -j REDIRECT --to-ports 1081
+func startTransparent(conf *common.Config) error {
+	if conf.Transparent == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", conf.Transparent)
+	if err != nil {
+		return err
+	}
+	log.Println("transparent proxy on", l.Addr())
+	go func() {
+		<-conf.Context.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Println("transparent", err)
+				return
+			}
+			go handTransparent(conf, conn.(*net.TCPConn))
+		}
+	}()
+	return nil
+}
+
+func handTransparent(conf *common.Config, conn *net.TCPConn) {
+	acs := common.NewACS(conn)
+	defer acs.Close()
+	dst, err := originalDst(conn)
+	if err == nil && dst.String() == conn.LocalAddr().String() {
+		err = errors.New("connection was not redirected")
+	}
+	if err != nil {
+		log.Println("transparent", conn.RemoteAddr(), err)
+		return
+	}
+	target := dst.String()
+	if host := sniffHost(acs); host != "" {
+		target = net.JoinHostPort(host, strconv.Itoa(dst.Port))
+	}
+	log.Println("transparent", conn.RemoteAddr(), "->", dst, "target:", target)
+	rAcs, err := common.DialRemote(conf, &common.Metadata{Source: conn.RemoteAddr()}, target)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer rAcs.Close()
+	// the deferred closes flush, so wait for both directions like forwards do
+	done := make(chan struct{}, 2)
+	go func() {
+		common.Transfer(rAcs.Open(), acs.Open(), "OUT")
+		done <- struct{}{}
+	}()
+	go func() {
+		common.Transfer(acs.Open(), rAcs.Open(), "IN")
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
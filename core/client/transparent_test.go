@@ -0,0 +1,94 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/muyuballs/go-proxy/core/common"
+)
+
+// redirected returns the proxy side of a tcp connection and the client side
+// talking to it.
+func redirected(t *testing.T) (*net.TCPConn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*net.TCPConn), client
+}
+
+func TestTransparentOriginalDst(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		got <- data
+	}()
+	dst := target.Addr().(*net.TCPAddr)
+	defer func(f func(*net.TCPConn) (*net.TCPAddr, error)) { originalDst = f }(originalDst)
+	originalDst = func(*net.TCPConn) (*net.TCPAddr, error) {
+		return dst, nil
+	}
+	conn, client := redirected(t)
+	done := make(chan struct{})
+	go func() {
+		handTransparent(&common.Config{}, conn)
+		close(done)
+	}()
+	// nothing to sniff, the connection goes to the looked up address
+	if _, err = client.Write([]byte{0x00, 0x01, 0x02}); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	select {
+	case data := <-got:
+		if string(data) != "\x00\x01\x02" {
+			t.Errorf("target got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing reached the original destination")
+	}
+	<-done
+}
+
+func TestTransparentNotRedirected(t *testing.T) {
+	defer func(f func(*net.TCPConn) (*net.TCPAddr, error)) { originalDst = f }(originalDst)
+	originalDst = func(conn *net.TCPConn) (*net.TCPAddr, error) {
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+	conn, client := redirected(t)
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handTransparent(&common.Config{}, conn)
+		close(done)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bufio.NewReader(client).ReadByte(); err != io.EOF {
+		t.Errorf("read = %v, want EOF", err)
+	}
+	<-done
+}
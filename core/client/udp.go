@@ -0,0 +1,195 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/muyuballs/go-proxy/core/common"
+	"github.com/muyuballs/go-proxy/core/socks"
+)
+
+type udpAssociation struct {
+	conf     *common.Config
+	relay    *net.UDPConn
+	clientIP net.IP
+	client   *net.UDPAddr
+	direct   *net.UDPConn
+	tunnels  map[string]*common.MuxStream
+	meta     *common.Metadata
+	lock     *sync.Mutex
+}
+
+// handUDPAssociate serves a socks5 UDP ASSOCIATE request, the relay lives
+// as long as the tcp control connection.
+func handUDPAssociate(conf *common.Config, acs *common.ACStream, req *socks.Request) {
+	var lip net.IP
+	if la, ok := acs.LocalAddr().(*net.TCPAddr); ok {
+		lip = la.IP
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: lip})
+	if err != nil {
+		log.Println(err)
+		socks.ReplySocks5(acs, socks.Socks5Rep(err), nil)
+		return
+	}
+	ua := &udpAssociation{
+		conf:    conf,
+		relay:   relay,
+		tunnels: make(map[string]*common.MuxStream),
+		meta:    &common.Metadata{Source: acs.RemoteAddr(), User: req.User},
+		lock:    &sync.Mutex{},
+	}
+	defer ua.Close()
+	if ra, ok := acs.RemoteAddr().(*net.TCPAddr); ok {
+		ua.clientIP = ra.IP
+	}
+	if expected, err := net.ResolveUDPAddr("udp", req.Target); err == nil && expected.Port != 0 && !expected.IP.IsUnspecified() {
+		ua.client = expected
+	}
+	err = socks.ReplySocks5(acs, socks.Socks5Rep(nil), relay.LocalAddr())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Println("udp associate", relay.LocalAddr(), "for", acs.RemoteAddr())
+	go ua.serve()
+	_, _ = io.Copy(ioutil.Discard, acs)
+	log.Println("udp associate done", relay.LocalAddr())
+}
+
+func (ua *udpAssociation) Close() {
+	ua.lock.Lock()
+	defer ua.lock.Unlock()
+	_ = ua.relay.Close()
+	if ua.direct != nil {
+		_ = ua.direct.Close()
+	}
+	for _, stream := range ua.tunnels {
+		_ = stream.Close()
+	}
+}
+
+func (ua *udpAssociation) accept(from *net.UDPAddr) bool {
+	ua.lock.Lock()
+	defer ua.lock.Unlock()
+	if ua.clientIP != nil && !ua.clientIP.Equal(from.IP) {
+		return false
+	}
+	if ua.client == nil {
+		ua.client = from
+		return true
+	}
+	return ua.client.IP.Equal(from.IP) && ua.client.Port == from.Port
+}
+
+func (ua *udpAssociation) reply(from string, data []byte) {
+	packet, err := socks.BuildUDPHeader(from, data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ua.lock.Lock()
+	client := ua.client
+	ua.lock.Unlock()
+	_, err = ua.relay.WriteToUDP(packet, client)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (ua *udpAssociation) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := ua.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !ua.accept(from) {
+			log.Println("drop udp packet from", from)
+			continue
+		}
+		target, data, err := socks.ParseUDPHeader(buf[:n])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		remote, err := common.RouteTarget(ua.conf, ua.meta, target)
+		if err == nil {
+			if remote == "" {
+				err = ua.sendDirect(target, data)
+			} else {
+				err = ua.sendTunnel(remote, target, data)
+			}
+		}
+		if err != nil {
+			log.Println("udp", target, err)
+		}
+	}
+}
+
+func (ua *udpAssociation) sendDirect(target string, data []byte) error {
+	raddr, err := common.ResolveUDPAddr(target)
+	if err != nil {
+		return err
+	}
+	ua.lock.Lock()
+	pc := ua.direct
+	if pc == nil {
+		pc, err = net.ListenUDP("udp", nil)
+		if err != nil {
+			ua.lock.Unlock()
+			return err
+		}
+		ua.direct = pc
+		go func() {
+			buf := make([]byte, 64*1024)
+			for {
+				n, from, err := pc.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				ua.reply(from.String(), buf[:n])
+			}
+		}()
+	}
+	ua.lock.Unlock()
+	_, err = pc.WriteToUDP(data, raddr)
+	return err
+}
+
+func (ua *udpAssociation) sendTunnel(remote, target string, data []byte) error {
+	ua.lock.Lock()
+	stream := ua.tunnels[remote]
+	ua.lock.Unlock()
+	if stream == nil {
+		var err error
+		stream, err = common.OpenTunnelUDP(ua.conf, remote)
+		if err != nil {
+			return err
+		}
+		ua.lock.Lock()
+		ua.tunnels[remote] = stream
+		ua.lock.Unlock()
+		go func() {
+			defer func() {
+				ua.lock.Lock()
+				if ua.tunnels[remote] == stream {
+					delete(ua.tunnels, remote)
+				}
+				ua.lock.Unlock()
+				stream.Close()
+			}()
+			for {
+				from, data, err := common.ReadDatagram(stream)
+				if err != nil {
+					return
+				}
+				ua.reply(from, data)
+			}
+		}()
+	}
+	return common.WriteDatagram(stream, target, data)
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+)
+
+/*
+	+------+----------+----------+
+	| ATYP | DST.ADDR | DST.PORT |
+	+------+----------+----------+
+	|  1   | Variable |    2     |
+	+------+----------+----------+
+*/
+
+// ReadAddr reads a socks5 style address and returns it as host:port.
+func ReadAddr(r io.Reader) (addr string, err error) {
+	atyp, err := ReadByte(r)
+	if err != nil {
+		return
+	}
+	var host string
+	var buf []byte
+	switch atyp {
+	case AtypIPv4:
+		buf = make([]byte, net.IPv4len+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case AtypIPv6:
+		buf = make([]byte, net.IPv6len+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	case AtypDomain:
+		domainLength, err := ReadByte(r)
+		if err != nil {
+			return "", err
+		}
+		buf = make([]byte, int(domainLength)+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return "", err
+		}
+		host = string(buf[:domainLength])
+	default:
+		return "", fmt.Errorf("not supported address type:%v", atyp)
+	}
+	port := binary.BigEndian.Uint16(buf[len(buf)-2:])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// AppendAddr appends host:port to buf in socks5 address format.
+func AppendAddr(buf []byte, addr string) ([]byte, error) {
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, AtypIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, AtypIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 0xFF {
+			return nil, errors.New("domain name too long")
+		}
+		buf = append(buf, AtypDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	return append(buf, byte(port>>8), byte(port)), nil
+}
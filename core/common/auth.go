@@ -0,0 +1,188 @@
+package common
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	TunnelVer = 0x01
+	// TunnelVer2 appends the requested compression to the handshake and the
+	// chosen one to the reply.
+	TunnelVer2 = 0x02
+
+	authNone     = 0x00
+	authToken    = 0x01
+	authUserPass = 0x02
+
+	authSuccess = 0x00
+	authFailed  = 0x01
+	authBadVer  = 0x02
+)
+
+var (
+	ErrAuthFailed = errors.New("tunnel authentication failed")
+)
+
+func writeLString(w io.Writer, s string) error {
+	if len(s) > 0xFFFF {
+		return fmt.Errorf("string too long:%d", len(s))
+	}
+	err := binary.Write(w, binary.BigEndian, uint16(len(s)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(s))
+	return err
+}
+
+func readLString(r io.Reader) (string, error) {
+	var l uint16
+	err := binary.Read(r, binary.BigEndian, &l)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, l)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func authRequired(conf *Config) bool {
+	return conf.Token != "" || conf.UsersFile != ""
+}
+
+// ClientHandshake sends the tunnel version and credential, then waits for the server verdict.
+// Compression is only requested when enabled, so old servers keep working.
+func ClientHandshake(ses io.ReadWriter, conf *Config) (compress byte, err error) {
+	ver := byte(TunnelVer)
+	if conf.Compress != CompressNone {
+		ver = TunnelVer2
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteByte(ver)
+	if conf.RemoteUser != "" {
+		i := strings.Index(conf.RemoteUser, ":")
+		if i < 0 {
+			return 0, errors.New("remote user must be user:password")
+		}
+		buf.WriteByte(authUserPass)
+		if err := writeLString(buf, conf.RemoteUser[:i]); err != nil {
+			return 0, err
+		}
+		if err := writeLString(buf, conf.RemoteUser[i+1:]); err != nil {
+			return 0, err
+		}
+	} else if conf.Token != "" {
+		buf.WriteByte(authToken)
+		if err := writeLString(buf, conf.Token); err != nil {
+			return 0, err
+		}
+	} else {
+		buf.WriteByte(authNone)
+	}
+	if ver == TunnelVer2 {
+		buf.WriteByte(conf.Compress)
+	}
+	_, err = ses.Write(buf.Bytes())
+	if err != nil {
+		return
+	}
+	if f, ok := ses.(Flusher); ok {
+		f.Flush()
+	}
+	rel := make([]byte, 2)
+	_, err = io.ReadFull(ses, rel)
+	if err != nil {
+		return
+	}
+	if rel[0] != ver {
+		return 0, fmt.Errorf("not supported tunnel version:%v", rel[0])
+	}
+	if rel[1] != authSuccess {
+		return 0, ErrAuthFailed
+	}
+	if ver == TunnelVer2 {
+		compress, err = ReadByte(ses)
+	}
+	return
+}
+
+// ServerHandshake reads the client credential and answers it, user is empty for token or anonymous sessions.
+func ServerHandshake(ses io.ReadWriter, conf *Config) (user string, compress byte, err error) {
+	defer func() {
+		if f, ok := ses.(Flusher); ok {
+			f.Flush()
+		}
+	}()
+	if c, ok := ses.(interface{ SetReadDeadline(time.Time) error }); ok && conf.ReadTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(time.Duration(conf.ReadTimeout) * time.Second))
+		defer c.SetReadDeadline(time.Time{})
+	}
+	ver, err := ReadByte(ses)
+	if err != nil {
+		return
+	}
+	if ver != TunnelVer && ver != TunnelVer2 {
+		ses.Write([]byte{TunnelVer, authBadVer})
+		return "", 0, fmt.Errorf("not supported tunnel version:%v", ver)
+	}
+	method, err := ReadByte(ses)
+	if err != nil {
+		return
+	}
+	passed := !authRequired(conf)
+	switch method {
+	case authNone:
+	case authToken:
+		token, err := readLString(ses)
+		if err != nil {
+			return "", 0, err
+		}
+		if conf.Token != "" && subtle.ConstantTimeCompare([]byte(conf.Token), []byte(token)) == 1 {
+			passed = true
+		}
+	case authUserPass:
+		user, err = readLString(ses)
+		if err != nil {
+			return
+		}
+		pass, err := readLString(ses)
+		if err != nil {
+			return "", 0, err
+		}
+		if CheckUser(user, pass) {
+			passed = true
+		}
+	default:
+		ses.Write([]byte{ver, authFailed})
+		return "", 0, fmt.Errorf("not supported auth method:%v", method)
+	}
+	if ver == TunnelVer2 {
+		compress, err = ReadByte(ses)
+		if err != nil {
+			return
+		}
+		if !compressSupported(compress) {
+			compress = CompressNone
+		}
+	}
+	if !passed {
+		ses.Write([]byte{ver, authFailed})
+		return "", 0, ErrAuthFailed
+	}
+	if ver == TunnelVer2 {
+		_, err = ses.Write([]byte{ver, authSuccess, compress})
+	} else {
+		_, err = ses.Write([]byte{ver, authSuccess})
+	}
+	return
+}
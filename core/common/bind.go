@@ -0,0 +1,221 @@
+package common
+
+import (
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+const bindTimeout = 2 * time.Minute
+
+// Binding is a listening socket waiting for one incoming connection, it is
+// opened locally or on the tunnel server depending on the route to peer.
+type Binding struct {
+	Addr   net.Addr
+	conf   *Config
+	peer   string
+	ln     *net.TCPListener
+	stream *MuxStream
+}
+
+// bindIP returns the local address used to reach peer, so the bound socket
+// is reachable from the peer side.
+func bindIP(peer string) net.IP {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return nil
+	}
+	c, err := net.Dial("udp", peer)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP
+}
+
+func listenBind(peer string) (*net.TCPListener, error) {
+	return net.ListenTCP("tcp", &net.TCPAddr{IP: bindIP(peer)})
+}
+
+// peerIPs resolves the host of a bind request, nil means any host may
+// connect.
+func peerIPs(peer string) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			return nil, nil
+		}
+		return []net.IP{ip}, nil
+	}
+	return net.LookupIP(host)
+}
+
+// acceptPeer waits for a connection from the host of the bind request,
+// RFC 1928 uses DST.ADDR to evaluate the incoming peer, others are refused.
+func acceptPeer(ln *net.TCPListener, peer string) (*net.TCPConn, error) {
+	ips, err := peerIPs(peer)
+	if err != nil {
+		return nil, err
+	}
+	ln.SetDeadline(time.Now().Add(bindTimeout))
+	for {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if ips == nil || containsPeer(ips, c.RemoteAddr().(*net.TCPAddr).IP) {
+			return c, nil
+		}
+		log.Println("bind: reject", c.RemoteAddr(), "expected", peer)
+		c.Close()
+	}
+}
+
+func containsPeer(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchClose closes c when the control connection acs ends while a bind
+// waits for its peer, stop ends the watch before acs is read again.
+func WatchClose(acs *ACStream, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := acs.Pick(1); err != nil {
+			select {
+			case <-stopped:
+			default:
+				log.Println("bind: control connection", err)
+				c.Close()
+			}
+		}
+	}()
+	return func() {
+		close(stopped)
+		acs.SetReadDeadline(time.Now())
+		<-done
+		acs.SetReadDeadline(time.Time{})
+	}
+}
+
+func Bind(conf *Config, meta *Metadata, peer string) (*Binding, error) {
+	remote, err := RouteTarget(conf, meta, peer)
+	if err != nil {
+		return nil, err
+	}
+	peer = mapTarget(peer)
+	b := &Binding{conf: conf, peer: peer}
+	if remote == "" {
+		b.ln, err = listenBind(peer)
+		if err != nil {
+			return nil, newDialError(peer, err)
+		}
+		b.Addr = b.ln.Addr()
+		return b, nil
+	}
+	ses, err := pickSession(conf, remote)
+	if err != nil {
+		return nil, newDialError(peer, err)
+	}
+	b.stream, err = ses.OpenBindStream(peer)
+	if err != nil {
+		return nil, newDialError(peer, err)
+	}
+	status, addr, err := b.stream.WaitReply(dialTimeout(conf))
+	if err == nil && status == StatusSuccess {
+		b.Addr, err = net.ResolveTCPAddr("tcp", addr)
+	}
+	if err != nil || status != StatusSuccess {
+		b.stream.Close()
+		if err != nil {
+			return nil, &DialError{Status: StatusOf(err), Target: peer, Err: err}
+		}
+		return nil, &DialError{Status: status, Target: peer}
+	}
+	return b, nil
+}
+
+// Accept waits for the peer and returns the connection with its address.
+func (b *Binding) Accept() (conn *ACStream, addr net.Addr, err error) {
+	if b.ln != nil {
+		c, err := acceptPeer(b.ln, b.peer)
+		if err != nil {
+			return nil, nil, newDialError(b.peer, err)
+		}
+		c.SetNoDelay(true)
+		return NewACS(c), c.RemoteAddr(), nil
+	}
+	status, raddr, err := b.stream.WaitReply(bindTimeout + dialTimeout(b.conf))
+	if err == nil && status == StatusSuccess {
+		addr, err = net.ResolveTCPAddr("tcp", raddr)
+	}
+	if err != nil {
+		return nil, nil, &DialError{Status: StatusOf(err), Target: b.peer, Err: err}
+	}
+	if status != StatusSuccess {
+		return nil, nil, &DialError{Status: status, Target: b.peer}
+	}
+	stream := b.stream
+	b.stream = nil
+	return NewACS(stream), addr, nil
+}
+
+func (b *Binding) Close() error {
+	if b.ln != nil {
+		return b.ln.Close()
+	}
+	if b.stream != nil {
+		return b.stream.Close()
+	}
+	return nil
+}
+
+// ServeBindStream listens for the peer of a bind stream on the tunnel
+// server, then relays the accepted connection over the stream.
+func ServeBindStream(conf *Config, stream *MuxStream) {
+	acs := NewACS(stream)
+	defer acs.Close()
+	log.Println("Bind:", stream.Target)
+	ln, err := listenBind(stream.Target)
+	if err != nil {
+		log.Println(err)
+		_ = stream.Reply(StatusOf(err), "")
+		return
+	}
+	defer ln.Close()
+	err = stream.Reply(StatusSuccess, ln.Addr().String())
+	if err != nil {
+		return
+	}
+	stop := WatchClose(acs, ln)
+	conn, err := acceptPeer(ln, stream.Target)
+	stop()
+	if err != nil {
+		log.Println(err)
+		_ = stream.Reply(StatusOf(err), "")
+		return
+	}
+	err = stream.Reply(StatusSuccess, conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetNoDelay(true)
+	cAcs := NewACS(conn)
+	defer cAcs.Close()
+	go Transfer(cAcs.Open(), acs.Open(), "IN")
+	go Transfer(acs.Open(), cAcs.Open(), "OUT")
+}
@@ -35,6 +35,18 @@ func FormatNS(raw float64) string {
 	return fmt.Sprintf("%.2fB", raw)
 }
 
+type flushWriter struct {
+	io.Writer
+}
+
+func (fw flushWriter) Write(buf []byte) (n int, err error) {
+	n, err = fw.Writer.Write(buf)
+	if f, ok := fw.Writer.(Flusher); ok {
+		f.Flush()
+	}
+	return
+}
+
 func Transfer(destination io.WriteCloser, source io.ReadCloser, flow string) {
 	if dacs, ok := destination.(*ACStream); ok {
 		defer dacs.CloseW()
@@ -47,7 +59,7 @@ func Transfer(destination io.WriteCloser, source io.ReadCloser, flow string) {
 		defer source.Close()
 	}
 	startTime := time.Now()
-	n, err := io.Copy(destination, source)
+	n, err := io.Copy(flushWriter{destination}, source)
 	cost := time.Since(startTime)
 	log.Printf("%v %v %v %v/s %v --> %v\n", flow, n, FormatNS(float64(n)), FormatNS(float64(n)/cost.Seconds()), cost, err)
 }
@@ -111,6 +123,8 @@ type ACStream struct {
 	c      io.Closer
 	refs   uint32
 	lock   *sync.Mutex
+	// wlock guards w, Close flushes while the other direction writes
+	wlock *sync.Mutex
 }
 
 func callFunc(origin interface{}, name string, args ...interface{}) (rel []interface{}, succ bool) {
@@ -218,9 +232,7 @@ func (acs *ACStream) Destroy() {
 func (acs *ACStream) Close() error {
 	acs.lock.Lock()
 	defer acs.lock.Unlock()
-	if acs.w != nil {
-		acs.w.Flush()
-	}
+	acs.Flush()
 	acs.refs -= 1
 	if acs.refs == 0 {
 		glock.Lock()
@@ -240,7 +252,9 @@ func (acs *ACStream) Open() *ACStream {
 
 func (acs *ACStream) Flush() {
 	if acs.w != nil {
+		acs.wlock.Lock()
 		acs.w.Flush()
+		acs.wlock.Unlock()
 	}
 }
 
@@ -258,6 +272,8 @@ func (acs *ACStream) Read(buf []byte) (int, error) {
 
 func (acs *ACStream) Write(buf []byte) (int, error) {
 	if acs.w != nil {
+		acs.wlock.Lock()
+		defer acs.wlock.Unlock()
 		return acs.w.Write(buf)
 	}
 	return 0, io.ErrShortWrite
@@ -278,6 +294,7 @@ func NewACS(base io.ReadWriteCloser) *ACStream {
 		c:      base,
 		refs:   1,
 		lock:   &sync.Mutex{},
+		wlock:  &sync.Mutex{},
 	}
 	aliveAcs[gAcsIndex] = acs
 	return acs
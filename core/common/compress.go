@@ -0,0 +1,159 @@
+package common
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	CompressNone  = 0x00
+	CompressFlate = 0x01
+)
+
+var compressNames = map[string]byte{
+	"none":  CompressNone,
+	"flate": CompressFlate,
+}
+
+func ParseCompress(name string) (byte, error) {
+	if m, ok := compressNames[name]; ok {
+		return m, nil
+	}
+	return 0, fmt.Errorf("unknown compression:%s", name)
+}
+
+func CompressName(m byte) string {
+	for name, v := range compressNames {
+		if v == m {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown(%d)", m)
+}
+
+func compressSupported(m byte) bool {
+	return m == CompressNone || m == CompressFlate
+}
+
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// compressConn compresses a tunnel session, writes are buffered until Flush
+// which the mux calls after every frame.
+type compressConn struct {
+	conn    io.ReadWriteCloser
+	r       io.ReadCloser
+	w       *flate.Writer
+	rawIn   int64
+	rawOut  int64
+	wireIn  int64
+	wireOut int64
+}
+
+// WrapCompress wraps the session connection with the negotiated compression.
+func WrapCompress(conn io.ReadWriteCloser, method byte) io.ReadWriteCloser {
+	if method != CompressFlate {
+		return conn
+	}
+	c := &compressConn{conn: conn}
+	c.r = flate.NewReader(countReader{conn, &c.wireIn})
+	c.w, _ = flate.NewWriter(countWriter{conn, &c.wireOut}, flate.BestSpeed)
+	return c
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.rawIn, int64(n))
+	return n, err
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.rawOut, int64(n))
+	return n, err
+}
+
+func (c *compressConn) Flush() {
+	if err := c.w.Flush(); err != nil {
+		return
+	}
+	if f, ok := c.conn.(Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressConn) Close() error {
+	c.r.Close()
+	return c.conn.Close()
+}
+
+func (c *compressConn) LocalAddr() net.Addr {
+	if a, ok := c.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return a.LocalAddr()
+	}
+	return nil
+}
+
+func (c *compressConn) RemoteAddr() net.Addr {
+	if a, ok := c.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return a.RemoteAddr()
+	}
+	return nil
+}
+
+// CompressStats returns the uncompressed and the on wire byte counts of
+// both directions.
+func (c *compressConn) CompressStats() (raw, wire int64) {
+	raw = atomic.LoadInt64(&c.rawIn) + atomic.LoadInt64(&c.rawOut)
+	wire = atomic.LoadInt64(&c.wireIn) + atomic.LoadInt64(&c.wireOut)
+	return
+}
+
+type compressStater interface {
+	CompressStats() (raw, wire int64)
+}
+
+// CompressRatio reports the wire/raw ratio of the session carrying s, ok is
+// false when s is not a compressed tunnel stream.
+func CompressRatio(s interface{}) (ratio float64, ok bool) {
+	if acs, isAcs := s.(*ACStream); isAcs {
+		s = acs.Origin()
+	}
+	var cs compressStater
+	switch v := s.(type) {
+	case *MuxStream:
+		cs, ok = v.session.conn.(compressStater)
+	case *MuxSession:
+		cs, ok = v.conn.(compressStater)
+	}
+	if !ok {
+		return 0, false
+	}
+	raw, wire := cs.CompressStats()
+	if raw == 0 {
+		return 1, true
+	}
+	return float64(wire) / float64(raw), true
+}
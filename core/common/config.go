@@ -2,7 +2,9 @@ package common
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
+	"net"
 )
 
 type Config struct {
@@ -11,10 +13,10 @@ type Config struct {
 	LogFlags         int
 	LogOut           io.Writer
 	LogFile          string
-	innerProxy       string
 	Listen           string
 	Certificate      string
 	CertKey          string
+	ServerKeyDir     string
 	ReadTimeout      int
 	IdleTimeout      int
 	WriteTimeout     int
@@ -29,4 +31,42 @@ type Config struct {
 	OnlyCacheRequest bool
 	DecryptHttps     bool
 	CertCache        string
+	Token            string
+	UsersFile        string
+	RemoteUser       string
+	MaxSessions      int
+	MaxStreams       int
+	NamedRemotes     map[string]string
+	ResolveRules     bool
+	GeoIPFile        string
+	RemoteStrategy   string
+	HealthInterval   int
+	RemoteCA         string
+	RemotePins       []string
+	KnownHosts       string
+	RemoteInsecure   bool
+	ClientCA         string
+	ClientCRL        string
+	ClientDeny       string
+	ClientCert       string
+	ClientKey        string
+	MaxUserStreams   int
+	Transport        string
+	WSPath           string
+	RemoteProxy      string
+	DecoyDir         string
+	ServerTLSConfig  *tls.Config
+	Compress         byte
+	Reverse          Reverse
+	ReversePorts     ReversePolicy
+	Forwards         map[string]string
+	UpstreamProxy    string
+	NamedUpstreams   map[string]string
+	Transparent      string
+	ProxyProtoFrom   []*net.IPNet
+	ProxyProtoOut    int
+	ProxyProtoTo     []*net.IPNet
+	HttpPoolIdle     int
+	HttpPoolTTL      int
+	CaptureBody      int
 }
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator checks the user name and password of tunnel and proxy clients.
+type Authenticator interface {
+	Authenticate(user, pass string) bool
+}
+
+// StaticAuthenticator holds plain text passwords.
+type StaticAuthenticator map[string]string
+
+func (a StaticAuthenticator) Authenticate(user, pass string) bool {
+	p, ok := a[user]
+	return ok && subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+}
+
+// PasswordSource is an Authenticator knowing the plain passwords, as needed
+// by http Digest auth.
+type PasswordSource interface {
+	Password(user string) (string, bool)
+}
+
+func (a StaticAuthenticator) Password(user string) (string, bool) {
+	p, ok := a[user]
+	return p, ok
+}
+
+// HtpasswdAuthenticator holds bcrypt hashes as written by htpasswd -B.
+type HtpasswdAuthenticator map[string][]byte
+
+func (a HtpasswdAuthenticator) Authenticate(user, pass string) bool {
+	h, ok := a[user]
+	return ok && bcrypt.CompareHashAndPassword(h, []byte(pass)) == nil
+}
+
+var (
+	authenticator Authenticator
+	authLock      = &sync.RWMutex{}
+)
+
+func SetAuthenticator(a Authenticator) {
+	authLock.Lock()
+	defer authLock.Unlock()
+	authenticator = a
+}
+
+func GetAuthenticator() Authenticator {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	return authenticator
+}
+
+func CheckUser(user, pass string) bool {
+	a := GetAuthenticator()
+	return a != nil && a.Authenticate(user, pass)
+}
+
+func isBcryptHash(p string) bool {
+	return strings.HasPrefix(p, "$2a$") || strings.HasPrefix(p, "$2b$") || strings.HasPrefix(p, "$2y$")
+}
+
+// ParseUsersFile reads user:password lines, the file is treated as an
+// htpasswd file when every password is a bcrypt hash.
+func ParseUsersFile(usersFile string) (Authenticator, error) {
+	f, err := os.Open(usersFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	hashed := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			log.Println("bad users file line:", line)
+			continue
+		}
+		users[line[:i]] = line[i+1:]
+		if isBcryptHash(line[i+1:]) {
+			hashed++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if hashed == 0 {
+		return StaticAuthenticator(users), nil
+	}
+	if hashed != len(users) {
+		return nil, errors.New("users file mixes plain and bcrypt passwords")
+	}
+	htpasswd := make(HtpasswdAuthenticator)
+	for u, p := range users {
+		htpasswd[u] = []byte(p)
+	}
+	return htpasswd, nil
+}
+
+func LoadUsers(conf *Config) error {
+	if conf.UsersFile == "" {
+		return nil
+	}
+	a, err := ParseUsersFile(conf.UsersFile)
+	if err != nil {
+		return err
+	}
+	SetAuthenticator(a)
+	log.Println("load users file", conf.UsersFile)
+	return nil
+}
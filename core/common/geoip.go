@@ -0,0 +1,76 @@
+package common
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var (
+	geoipDB   *maxminddb.Reader
+	geoipLock = &sync.RWMutex{}
+)
+
+type geoipRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// LoadGeoIP opens the GeoLite2-Country format database used by GEOIP rules.
+func LoadGeoIP(conf *Config) error {
+	if conf.GeoIPFile == "" {
+		return nil
+	}
+	db, err := maxminddb.Open(conf.GeoIPFile)
+	if err != nil {
+		return err
+	}
+	log.Println("load geoip database", db.Metadata.DatabaseType, db.Metadata.BuildEpoch)
+	geoipLock.Lock()
+	defer geoipLock.Unlock()
+	if geoipDB != nil {
+		geoipDB.Close()
+	}
+	geoipDB = db
+	return nil
+}
+
+// LookupCountry returns the iso country code of ip, or "" when unknown.
+func LookupCountry(ip net.IP) string {
+	geoipLock.RLock()
+	defer geoipLock.RUnlock()
+	if geoipDB == nil {
+		return ""
+	}
+	var record geoipRecord
+	err := geoipDB.Lookup(ip, &record)
+	if err != nil {
+		log.Println("geoip", ip, err)
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+type geoipMatcher struct {
+	code      string
+	noResolve bool
+}
+
+func (m geoipMatcher) Match(req *RouteRequest) bool {
+	for _, ip := range req.IPs(!m.noResolve) {
+		if strings.EqualFold(LookupCountry(ip), m.code) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+// testdata/geoip.mmdb is written by testdata/mkmmdb.py: 127.0.0.0/8 is CN,
+// 10.0.0.0/8 only has the registered country US.
+
+func loadTestGeoIP(t *testing.T, file string) error {
+	t.Helper()
+	t.Cleanup(func() {
+		geoipLock.Lock()
+		defer geoipLock.Unlock()
+		if geoipDB != nil {
+			geoipDB.Close()
+			geoipDB = nil
+		}
+	})
+	return LoadGeoIP(&Config{GeoIPFile: file})
+}
+
+func matchRule(t *testing.T, line string, conf *Config, target string) bool {
+	t.Helper()
+	r, err := ParseRule(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.Matcher.Match(newRouteRequest(conf, nil, target))
+}
+
+func TestLookupCountry(t *testing.T) {
+	if err := loadTestGeoIP(t, "testdata/geoip.mmdb"); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"127.0.0.1":   "CN",
+		"127.255.0.9": "CN",
+		"10.1.2.3":    "US",
+		"8.8.8.8":     "",
+		"128.0.0.1":   "",
+	}
+	for ip, want := range cases {
+		if got := LookupCountry(net.ParseIP(ip)); got != want {
+			t.Errorf("LookupCountry(%s) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestGeoIPRule(t *testing.T) {
+	if err := loadTestGeoIP(t, "testdata/geoip.mmdb"); err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{}
+	cases := []struct {
+		line   string
+		target string
+		want   bool
+	}{
+		{"GEOIP,CN,DIRECT", "127.0.0.1:80", true},
+		{"GEOIP,cn,DIRECT", "127.0.0.1:80", true},
+		{"GEOIP,CN,DIRECT", "8.8.8.8:53", false},
+		{"GEOIP,US,DIRECT", "10.0.0.1:443", true},
+		{"GEOIP,CN,DIRECT", "10.0.0.1:443", false},
+		// domains are never resolved without --resolve-rules
+		{"GEOIP,CN,DIRECT", "localhost:80", false},
+	}
+	for _, c := range cases {
+		if got := matchRule(t, c.line, conf, c.target); got != c.want {
+			t.Errorf("%s on %s = %v, want %v", c.line, c.target, got, c.want)
+		}
+	}
+}
+
+func TestGeoIPRuleResolve(t *testing.T) {
+	if err := loadTestGeoIP(t, "testdata/geoip.mmdb"); err != nil {
+		t.Fatal(err)
+	}
+	AddHostMapping("cn.example", "127.0.0.1")
+	defer DelHostMapping("cn.example")
+	conf := &Config{ResolveRules: true}
+	if !matchRule(t, "GEOIP,CN,DIRECT", conf, "cn.example:80") {
+		t.Error("resolved domain should match")
+	}
+	if matchRule(t, "GEOIP,CN,DIRECT,no-resolve", conf, "cn.example:80") {
+		t.Error("no-resolve rule resolved the domain")
+	}
+}
+
+func TestGeoIPMissingDatabase(t *testing.T) {
+	if err := loadTestGeoIP(t, "testdata/missing.mmdb"); err == nil {
+		t.Fatal("want an error for a missing database")
+	}
+	if got := LookupCountry(net.ParseIP("127.0.0.1")); got != "" {
+		t.Errorf("LookupCountry without database = %q", got)
+	}
+	if matchRule(t, "GEOIP,CN,DIRECT", &Config{}, "127.0.0.1:80") {
+		t.Error("GEOIP matched without database")
+	}
+	if err := LoadGeoIP(&Config{}); err != nil {
+		t.Errorf("no --geoip-db: %v", err)
+	}
+}
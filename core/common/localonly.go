@@ -7,46 +7,47 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
-	localOnlyList = make([]*regexp.Regexp, 0)
-	lolLock       = &sync.RWMutex{}
-	parseLock     = &sync.Mutex{}
+	rules     = make([]*Rule, 0)
+	lolLock   = &sync.RWMutex{}
+	parseLock = &sync.Mutex{}
 )
 
+// IsLocalOnly reports whether the first rule matching host routes it direct.
 func IsLocalOnly(host string) bool {
+	req := newRouteRequest(nil, nil, host)
 	lolLock.RLock()
 	defer lolLock.RUnlock()
-	if len(localOnlyList) == 0 {
-		return false
-	}
-	for _, r := range localOnlyList {
-		if r.MatchString(host) {
-			return true
+	for _, r := range rules {
+		if r.Matcher.Match(req) {
+			return r.Action.Type == ActionDirect
 		}
 	}
 	return false
 }
 
 func AddLocalOnly(expr string) (err error) {
-	lolLock.Lock()
-	defer lolLock.Unlock()
 	r, err := regexp.Compile(string(expr))
 	if err != nil {
 		return
 	}
-	localOnlyList = append(localOnlyList, r)
+	lolLock.Lock()
+	defer lolLock.Unlock()
+	rules = append(rules, &Rule{Raw: expr, Matcher: legacyMatcher{r}, Action: Action{Type: ActionDirect}})
 	return
 }
 
 func DelLocalOnly(expr *regexp.Regexp) {
 	lolLock.Lock()
 	defer lolLock.Unlock()
-	for i := range localOnlyList {
-		if localOnlyList[i] == expr {
-			localOnlyList = append(localOnlyList[:i], localOnlyList[i+1:]...)
+	for i, r := range rules {
+		if m, ok := r.Matcher.(legacyMatcher); ok && m.Regexp == expr {
+			rules = append(rules[:i], rules[i+1:]...)
 			break
 		}
 	}
@@ -56,28 +57,55 @@ func ListLocalOnly() (list []*regexp.Regexp) {
 	lolLock.RLock()
 	defer lolLock.RUnlock()
 	list = make([]*regexp.Regexp, 0)
-	for _, r := range localOnlyList {
-		list = append(list, r)
+	for _, r := range rules {
+		if m, ok := r.Matcher.(legacyMatcher); ok {
+			list = append(list, m.Regexp)
+		}
 	}
 	return
 }
 
-func ParseLolFile(lolFile string) {
-	defer func() {
-		for _, r := range localOnlyList {
-			log.Println(r.String())
+func AddRule(line string) error {
+	r, err := ParseRule(line)
+	if err != nil {
+		return err
+	}
+	lolLock.Lock()
+	defer lolLock.Unlock()
+	rules = append(rules, r)
+	return nil
+}
+
+func DelRule(rule *Rule) {
+	lolLock.Lock()
+	defer lolLock.Unlock()
+	for i, r := range rules {
+		if r == rule {
+			rules = append(rules[:i], rules[i+1:]...)
+			break
 		}
-	}()
+	}
+}
+
+func ListRules() (list []*Rule) {
+	lolLock.RLock()
+	defer lolLock.RUnlock()
+	list = make([]*Rule, len(rules))
+	copy(list, rules)
+	return
+}
+
+func ParseLolFile(lolFile string) {
 	parseLock.Lock()
 	defer parseLock.Unlock()
-	log.Println("parse localOnlyList file")
+	log.Println("parse rules file")
 	f, err := os.Open(lolFile)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer f.Close()
-	tlol := make([]*regexp.Regexp, 0)
+	trules := make([]*Rule, 0)
 	reader := bufio.NewReader(f)
 	for {
 		ld, _, err := reader.ReadLine()
@@ -89,22 +117,27 @@ func ParseLolFile(lolFile string) {
 				break
 			}
 		}
-		r, err := regexp.Compile(string(ld))
+		line := strings.TrimSpace(string(ld))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRule(line)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
-		tlol = append(tlol, r)
+		log.Println(r.Raw, "=>", r.Action)
+		trules = append(trules, r)
 	}
 	lolLock.Lock()
 	defer lolLock.Unlock()
-	localOnlyList = tlol
+	rules = trules
 }
 
 func LoadLol(conf *Config) error {
 	if len(conf.LolFile) > 0 {
-		log.Println("load localOnlyList list")
-		defer log.Println("localOnlyList list load done.")
+		log.Println("load rules")
+		defer log.Println("rules load done.")
 		ParseLolFile(conf.LolFile)
 		go func() {
 			w, err := fsnotify.NewWatcher()
@@ -123,6 +156,14 @@ func LoadLol(conf *Config) error {
 				case event := <-w.Events:
 					if event.Op&fsnotify.Write == fsnotify.Write {
 						ParseLolFile(conf.LolFile)
+					} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+						// editors often save by replacing the file, watch the new one
+						time.Sleep(100 * time.Millisecond)
+						if err := w.Add(conf.LolFile); err != nil {
+							log.Println(err)
+							continue
+						}
+						ParseLolFile(conf.LolFile)
 					}
 				case err := <-w.Errors:
 					log.Println(err)
@@ -0,0 +1,743 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	+------+-----------+--------+---------+
+	| TYPE | STREAM ID | LENGTH | PAYLOAD |
+	+------+-----------+--------+---------+
+	|  1   |     4     |   4    |   LEN   |
+	+------+-----------+--------+---------+
+*/
+
+const (
+	frameOpen     = 0x01 //payload: target
+	frameData     = 0x02
+	frameWindow   = 0x03 //payload: uint32 window increment
+	frameClose    = 0x04 //half close, no more data from sender
+	frameReset    = 0x05
+	frameReply    = 0x06 //payload: status, bound address
+	frameOpenUDP  = 0x07 //datagram stream, see WriteDatagram
+	frameOpenBind = 0x08 //payload: expected peer, answered by two replies
+	framePing     = 0x09 //stream id is the ping sequence
+	framePong     = 0x0A
+	frameListen   = 0x0B //payload: listen address on the server, for reverse tunnels
+
+	frameHeaderLen  = 9
+	maxFramePayload = 16 * 1024
+	maxOpenPayload  = 0xFFFF
+	initialWindow   = 256 * 1024
+	acceptBacklog   = 64
+	ctrlBacklog     = 256
+)
+
+const (
+	KindConnect = frameOpen
+	KindUDP     = frameOpenUDP
+	KindBind    = frameOpenBind
+	KindListen  = frameListen
+)
+
+var (
+	ErrSessionClosed  = errors.New("mux session closed")
+	ErrStreamReset    = errors.New("mux stream reset by peer")
+	ErrStreamClosed   = errors.New("mux stream closed")
+	ErrTooManyStreams = errors.New("too many mux streams")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type MuxSession struct {
+	conn       io.ReadWriteCloser
+	r          *bufio.Reader
+	client     bool
+	maxStreams int
+	nextID     uint32
+	streams    map[uint32]*MuxStream
+	accept     chan *MuxStream
+	lock       *sync.Mutex
+	wlock      *sync.Mutex
+	closed     chan struct{}
+	closeOnce  *sync.Once
+	err        error
+	pingSeq    uint32
+	pings      map[uint32]chan struct{}
+	ctrl       chan ctrlFrame
+}
+
+// ctrlFrame is a frame the receive loop has to send, like a pong or the
+// reset of a refused stream.
+type ctrlFrame struct {
+	tpe     byte
+	id      uint32
+	payload []byte
+}
+
+// NewMuxSession starts a mux session over an authenticated tunnel connection,
+// both sides accept streams opened by the peer, the server opens them for
+// reverse tunnels.
+func NewMuxSession(conn io.ReadWriteCloser, client bool, maxStreams int) *MuxSession {
+	ses := &MuxSession{
+		conn:       conn,
+		r:          bufio.NewReaderSize(conn, frameHeaderLen+maxFramePayload),
+		client:     client,
+		maxStreams: maxStreams,
+		streams:    make(map[uint32]*MuxStream),
+		pings:      make(map[uint32]chan struct{}),
+		lock:       &sync.Mutex{},
+		wlock:      &sync.Mutex{},
+		closed:     make(chan struct{}),
+		closeOnce:  &sync.Once{},
+		accept:     make(chan *MuxStream, acceptBacklog),
+		ctrl:       make(chan ctrlFrame, ctrlBacklog),
+	}
+	if client {
+		ses.nextID = 1
+	} else {
+		ses.nextID = 2
+	}
+	go ses.recvLoop()
+	go ses.ctrlLoop()
+	return ses
+}
+
+func (ses *MuxSession) LocalAddr() net.Addr {
+	if c, ok := ses.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+func (ses *MuxSession) RemoteAddr() net.Addr {
+	if c, ok := ses.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
+func (ses *MuxSession) NumStreams() int {
+	ses.lock.Lock()
+	defer ses.lock.Unlock()
+	return len(ses.streams)
+}
+
+func (ses *MuxSession) IsClosed() bool {
+	select {
+	case <-ses.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ses *MuxSession) Close() error {
+	ses.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (ses *MuxSession) closeWithError(err error) {
+	ses.closeOnce.Do(func() {
+		ses.lock.Lock()
+		ses.err = err
+		streams := ses.streams
+		ses.streams = make(map[uint32]*MuxStream)
+		ses.lock.Unlock()
+		close(ses.closed)
+		_ = ses.conn.Close()
+		for _, st := range streams {
+			st.abort(ErrSessionClosed)
+		}
+	})
+}
+
+// Ping sends a ping frame and returns the round trip time of the answer.
+func (ses *MuxSession) Ping(timeout time.Duration) (time.Duration, error) {
+	ses.lock.Lock()
+	ses.pingSeq++
+	seq := ses.pingSeq
+	pong := make(chan struct{})
+	ses.pings[seq] = pong
+	ses.lock.Unlock()
+	defer func() {
+		ses.lock.Lock()
+		delete(ses.pings, seq)
+		ses.lock.Unlock()
+	}()
+	start := time.Now()
+	if err := ses.writeFrame(framePing, seq, nil); err != nil {
+		return 0, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-ses.closed:
+		return 0, ses.err
+	case <-timer.C:
+		return 0, timeoutError{}
+	}
+}
+
+func (ses *MuxSession) OpenStream(target string) (*MuxStream, error) {
+	return ses.openStream(frameOpen, target)
+}
+
+func (ses *MuxSession) OpenDatagramStream() (*MuxStream, error) {
+	return ses.openStream(frameOpenUDP, "")
+}
+
+func (ses *MuxSession) OpenBindStream(peer string) (*MuxStream, error) {
+	return ses.openStream(frameOpenBind, peer)
+}
+
+// OpenListenStream asks the server to listen on addr, accepted connections
+// come back as streams opened by the server with addr as target.
+func (ses *MuxSession) OpenListenStream(addr string) (*MuxStream, error) {
+	return ses.openStream(frameListen, addr)
+}
+
+func (ses *MuxSession) openStream(tpe byte, target string) (*MuxStream, error) {
+	if len(target) > maxOpenPayload {
+		return nil, fmt.Errorf("target too long:%d", len(target))
+	}
+	ses.lock.Lock()
+	if ses.IsClosed() {
+		ses.lock.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if ses.maxStreams > 0 && len(ses.streams) >= ses.maxStreams {
+		ses.lock.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	st := newMuxStream(ses, ses.nextID, target)
+	st.Kind = tpe
+	ses.nextID += 2
+	ses.streams[st.id] = st
+	ses.lock.Unlock()
+	if err := ses.writeFrame(tpe, st.id, []byte(target)); err != nil {
+		ses.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (ses *MuxSession) AcceptStream() (*MuxStream, error) {
+	select {
+	case st := <-ses.accept:
+		return st, nil
+	case <-ses.closed:
+		return nil, ses.err
+	}
+}
+
+func (ses *MuxSession) removeStream(id uint32) {
+	ses.lock.Lock()
+	defer ses.lock.Unlock()
+	delete(ses.streams, id)
+}
+
+func (ses *MuxSession) getStream(id uint32) *MuxStream {
+	ses.lock.Lock()
+	defer ses.lock.Unlock()
+	return ses.streams[id]
+}
+
+func (ses *MuxSession) writeFrame(tpe byte, id uint32, payload []byte) error {
+	buf := make([]byte, frameHeaderLen+len(payload))
+	buf[0] = tpe
+	binary.BigEndian.PutUint32(buf[1:], id)
+	binary.BigEndian.PutUint32(buf[5:], uint32(len(payload)))
+	copy(buf[frameHeaderLen:], payload)
+	ses.wlock.Lock()
+	defer ses.wlock.Unlock()
+	if ses.IsClosed() {
+		return ErrSessionClosed
+	}
+	_, err := ses.conn.Write(buf)
+	if err == nil {
+		if f, ok := ses.conn.(Flusher); ok {
+			f.Flush()
+		}
+	}
+	if err != nil {
+		go ses.closeWithError(err)
+	}
+	return err
+}
+
+// queueFrame hands a frame to ctrlLoop, so a blocked writer never stalls
+// the receive loop and with it every other stream.
+func (ses *MuxSession) queueFrame(tpe byte, id uint32, payload []byte) {
+	select {
+	case ses.ctrl <- ctrlFrame{tpe: tpe, id: id, payload: payload}:
+	case <-ses.closed:
+	default:
+		go ses.writeFrame(tpe, id, payload)
+	}
+}
+
+func (ses *MuxSession) ctrlLoop() {
+	for {
+		select {
+		case f := <-ses.ctrl:
+			_ = ses.writeFrame(f.tpe, f.id, f.payload)
+		case <-ses.closed:
+			return
+		}
+	}
+}
+
+func (ses *MuxSession) recvLoop() {
+	header := make([]byte, frameHeaderLen)
+	for {
+		_, err := io.ReadFull(ses.r, header)
+		if err != nil {
+			ses.closeWithError(err)
+			return
+		}
+		tpe := header[0]
+		id := binary.BigEndian.Uint32(header[1:])
+		length := binary.BigEndian.Uint32(header[5:])
+		if length > maxOpenPayload || (!isOpenFrame(tpe) && length > maxFramePayload) {
+			log.Println("mux frame too large", tpe, length)
+			ses.closeWithError(errors.New("mux protocol error"))
+			return
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(ses.r, payload)
+		if err != nil {
+			ses.closeWithError(err)
+			return
+		}
+		ses.handleFrame(tpe, id, payload)
+	}
+}
+
+func isOpenFrame(tpe byte) bool {
+	return tpe == frameOpen || tpe == frameOpenUDP || tpe == frameOpenBind || tpe == frameListen
+}
+
+func (ses *MuxSession) handleFrame(tpe byte, id uint32, payload []byte) {
+	switch {
+	case isOpenFrame(tpe):
+		ses.handleOpen(tpe, id, payload)
+		return
+	case tpe == framePing:
+		ses.queueFrame(framePong, id, nil)
+		return
+	case tpe == framePong:
+		ses.lock.Lock()
+		if pong, ok := ses.pings[id]; ok {
+			close(pong)
+			delete(ses.pings, id)
+		}
+		ses.lock.Unlock()
+		return
+	}
+	st := ses.getStream(id)
+	if st == nil {
+		return
+	}
+	switch tpe {
+	case frameData:
+		st.pushData(payload)
+	case frameWindow:
+		if len(payload) == 4 {
+			st.addSendWindow(binary.BigEndian.Uint32(payload))
+		}
+	case frameClose:
+		st.remoteClose()
+	case frameReply:
+		if len(payload) > 0 {
+			st.pushReply(payload[0], string(payload[1:]))
+		}
+	case frameReset:
+		ses.removeStream(id)
+		st.abort(ErrStreamReset)
+	default:
+		log.Println("unknown mux frame", tpe)
+	}
+}
+
+func (ses *MuxSession) handleOpen(tpe byte, id uint32, payload []byte) {
+	// the client opens odd ids and the server even ones, the peer can't
+	// open a stream with our parity
+	if id == 0 || (id%2 == 1) == ses.client {
+		ses.queueFrame(frameReset, id, nil)
+		return
+	}
+	ses.lock.Lock()
+	if _, ok := ses.streams[id]; ok || (ses.maxStreams > 0 && len(ses.streams) >= ses.maxStreams) {
+		ses.lock.Unlock()
+		log.Println("reject mux stream", id)
+		ses.queueFrame(frameReset, id, nil)
+		return
+	}
+	st := newMuxStream(ses, id, string(payload))
+	st.Kind = tpe
+	ses.streams[id] = st
+	ses.lock.Unlock()
+	select {
+	case ses.accept <- st:
+	default:
+		ses.removeStream(id)
+		ses.queueFrame(frameReset, id, nil)
+	}
+}
+
+type muxReply struct {
+	status    byte
+	boundAddr string
+}
+
+type MuxStream struct {
+	id          uint32
+	session     *MuxSession
+	Target      string
+	Kind        byte
+	lock        *sync.Mutex
+	cond        *sync.Cond
+	buf         bytes.Buffer
+	recvWindow  uint32
+	consumed    uint32
+	sendWindow  uint32
+	readClosed  bool
+	writeClosed bool
+	closed      bool
+	replies     []muxReply
+	boundAddr   string
+	err         error
+	rDeadline   time.Time
+	wDeadline   time.Time
+	replyWait   time.Time
+	timer       *time.Timer
+}
+
+func newMuxStream(ses *MuxSession, id uint32, target string) *MuxStream {
+	st := &MuxStream{
+		id:         id,
+		session:    ses,
+		Target:     target,
+		lock:       &sync.Mutex{},
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+	}
+	st.cond = sync.NewCond(st.lock)
+	return st
+}
+
+func (st *MuxStream) ID() uint32 {
+	return st.id
+}
+
+func (st *MuxStream) Session() *MuxSession {
+	return st.session
+}
+
+func (st *MuxStream) pushData(data []byte) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.err != nil || st.readClosed {
+		return
+	}
+	if uint32(len(data)) > st.recvWindow {
+		st.err = errors.New("mux flow control violation")
+		st.cond.Broadcast()
+		st.session.queueFrame(frameReset, st.id, nil)
+		return
+	}
+	st.recvWindow -= uint32(len(data))
+	if !st.closed {
+		st.buf.Write(data)
+	}
+	st.cond.Broadcast()
+}
+
+func (st *MuxStream) pushReply(status byte, boundAddr string) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.replies = append(st.replies, muxReply{status: status, boundAddr: boundAddr})
+	st.cond.Broadcast()
+}
+
+// Reply tells the opener whether the stream target was reached, bind
+// streams are answered twice.
+func (st *MuxStream) Reply(status byte, boundAddr string) error {
+	payload := append([]byte{status}, boundAddr...)
+	return st.session.writeFrame(frameReply, st.id, payload)
+}
+
+// WaitReply blocks until the peer answered the open request.
+func (st *MuxStream) WaitReply(timeout time.Duration) (status byte, boundAddr string, err error) {
+	deadline := time.Now().Add(timeout)
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.replyWait = deadline
+	st.armTimer()
+	defer func() {
+		st.replyWait = time.Time{}
+	}()
+	for len(st.replies) == 0 {
+		if st.err != nil {
+			return StatusGeneralFailure, "", st.err
+		}
+		if !time.Now().Before(deadline) {
+			return StatusTimeout, "", timeoutError{}
+		}
+		st.cond.Wait()
+	}
+	rep := st.replies[0]
+	st.replies = st.replies[1:]
+	if rep.status == StatusSuccess && rep.boundAddr != "" {
+		st.boundAddr = rep.boundAddr
+	}
+	return rep.status, rep.boundAddr, nil
+}
+
+func (st *MuxStream) addSendWindow(n uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+}
+
+func (st *MuxStream) remoteClose() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.readClosed = true
+	st.cond.Broadcast()
+	if st.writeClosed {
+		st.session.removeStream(st.id)
+	}
+}
+
+func (st *MuxStream) abort(err error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.stopTimer()
+	st.cond.Broadcast()
+}
+
+// armTimer sets the one timer of the stream to wake the waiters at the next
+// deadline still ahead, st.lock held.
+func (st *MuxStream) armTimer() {
+	now := time.Now()
+	var next time.Time
+	for _, t := range []time.Time{st.rDeadline, st.wDeadline, st.replyWait} {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	if next.IsZero() {
+		st.stopTimer()
+		return
+	}
+	if st.timer == nil {
+		st.timer = time.AfterFunc(next.Sub(now), st.wake)
+		return
+	}
+	st.timer.Stop()
+	st.timer.Reset(next.Sub(now))
+}
+
+func (st *MuxStream) stopTimer() {
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+}
+
+func (st *MuxStream) wake() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.cond.Broadcast()
+	if st.err == nil {
+		st.armTimer()
+	}
+}
+
+func (st *MuxStream) Read(buf []byte) (n int, err error) {
+	st.lock.Lock()
+	for st.buf.Len() == 0 {
+		if st.err != nil {
+			st.lock.Unlock()
+			return 0, st.err
+		}
+		if st.readClosed || st.closed {
+			st.lock.Unlock()
+			return 0, io.EOF
+		}
+		if !st.rDeadline.IsZero() && !time.Now().Before(st.rDeadline) {
+			st.lock.Unlock()
+			return 0, timeoutError{}
+		}
+		st.cond.Wait()
+	}
+	n, _ = st.buf.Read(buf)
+	st.consumed += uint32(n)
+	var inc uint32
+	if st.consumed >= initialWindow/2 && !st.readClosed {
+		inc = st.consumed
+		st.recvWindow += inc
+		st.consumed = 0
+	}
+	st.lock.Unlock()
+	if inc > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, inc)
+		_ = st.session.writeFrame(frameWindow, st.id, payload)
+	}
+	return n, nil
+}
+
+func (st *MuxStream) Write(buf []byte) (n int, err error) {
+	for n < len(buf) {
+		st.lock.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.writeClosed {
+			if !st.wDeadline.IsZero() && !time.Now().Before(st.wDeadline) {
+				st.lock.Unlock()
+				return n, timeoutError{}
+			}
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			st.lock.Unlock()
+			return n, st.err
+		}
+		if st.writeClosed {
+			st.lock.Unlock()
+			return n, ErrStreamClosed
+		}
+		size := len(buf) - n
+		if size > maxFramePayload {
+			size = maxFramePayload
+		}
+		if uint32(size) > st.sendWindow {
+			size = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(size)
+		st.lock.Unlock()
+		err = st.session.writeFrame(frameData, st.id, buf[n:n+size])
+		if err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+func (st *MuxStream) CloseWrite() error {
+	st.lock.Lock()
+	if st.writeClosed || st.err != nil {
+		st.lock.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	remove := st.readClosed
+	st.cond.Broadcast()
+	st.lock.Unlock()
+	if remove {
+		st.session.removeStream(st.id)
+	}
+	return st.session.writeFrame(frameClose, st.id, nil)
+}
+
+func (st *MuxStream) CloseRead() error {
+	return nil
+}
+
+// Close sends FIN when the peer already finished sending, otherwise the
+// stream is reset so the peer stops writing into a dead stream.
+func (st *MuxStream) Close() error {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf.Reset()
+	tpe := byte(0)
+	if st.err == nil {
+		if !st.readClosed {
+			tpe = frameReset
+		} else if !st.writeClosed {
+			tpe = frameClose
+		}
+	}
+	st.writeClosed = true
+	if st.err == nil {
+		st.err = ErrStreamClosed
+	}
+	st.stopTimer()
+	st.cond.Broadcast()
+	st.lock.Unlock()
+	st.session.removeStream(st.id)
+	if tpe != 0 {
+		return st.session.writeFrame(tpe, st.id, nil)
+	}
+	return nil
+}
+
+// BoundAddr returns the address the peer used for the stream target, as
+// reported by the last successful reply.
+func (st *MuxStream) BoundAddr() net.Addr {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.boundAddr == "" {
+		return nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", st.boundAddr)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+func (st *MuxStream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *MuxStream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.rDeadline = t
+	st.armTimer()
+	st.cond.Broadcast()
+	st.lock.Unlock()
+	return nil
+}
+
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.wDeadline = t
+	st.armTimer()
+	st.cond.Broadcast()
+	st.lock.Unlock()
+	return nil
+}
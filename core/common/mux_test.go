@@ -0,0 +1,212 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func muxPair(t *testing.T, maxStreams int) (client, server *MuxSession) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	client = NewMuxSession(c1, true, 0)
+	server = NewMuxSession(c2, false, maxStreams)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func openPair(t *testing.T, client, server *MuxSession) (*MuxStream, *MuxStream) {
+	t.Helper()
+	st, err := client.OpenStream("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Target != "example.com:80" || peer.ID() != st.ID() {
+		t.Fatalf("accepted %d %q, opened %d", peer.ID(), peer.Target, st.ID())
+	}
+	return st, peer
+}
+
+// readFrame reads one raw frame written by a session.
+func readFrame(t *testing.T, r io.Reader) (tpe byte, id uint32) {
+	t.Helper()
+	header := make([]byte, frameHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(binary.BigEndian.Uint32(header[5:]))); err != nil {
+		t.Fatal(err)
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:])
+}
+
+func TestMuxWindow(t *testing.T) {
+	client, server := muxPair(t, 0)
+	st, peer := openPair(t, client, server)
+	data := make([]byte, initialWindow+3*maxFramePayload)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	// nothing is read, the writer stops when the window is used up
+	st.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := st.Write(data)
+	if n != initialWindow {
+		t.Fatalf("wrote %d bytes into a window of %d", n, initialWindow)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("write error %v, want a timeout", err)
+	}
+	// reading opens the window again and the rest goes through
+	st.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data[n:])
+		done <- err
+	}()
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(peer, got); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data changed on the way")
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	client, server := muxPair(t, 0)
+	st, peer := openPair(t, client, server)
+	// closed before the client finished sending, the stream is reset
+	peer.Close()
+	if _, err := st.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("read = %v, want %v", err, ErrStreamReset)
+	}
+	if _, err := st.Write([]byte("x")); err != ErrStreamReset {
+		t.Errorf("write = %v, want %v", err, ErrStreamReset)
+	}
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("%d streams left after reset", n)
+	}
+	// the end of the session aborts the streams still open
+	st, _ = openPair(t, client, server)
+	server.Close()
+	if _, err := st.Read(make([]byte, 1)); err != ErrSessionClosed {
+		t.Errorf("read = %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := client.OpenStream("example.com:80"); err != ErrSessionClosed {
+		t.Errorf("open = %v, want %v", err, ErrSessionClosed)
+	}
+}
+
+func TestMuxMaxStreams(t *testing.T) {
+	client, server := muxPair(t, 1)
+	openPair(t, client, server)
+	st, err := client.OpenStream("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = st.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("stream over the limit: read = %v, want %v", err, ErrStreamReset)
+	}
+	if n := server.NumStreams(); n != 1 {
+		t.Errorf("server has %d streams, want 1", n)
+	}
+}
+
+func TestMuxOpenParity(t *testing.T) {
+	c1, c2 := net.Pipe()
+	ses := NewMuxSession(c1, false, 0)
+	defer ses.Close()
+	defer c2.Close()
+	c2.SetDeadline(time.Now().Add(5 * time.Second))
+	// a client opening an even id takes one the server would use
+	for _, id := range []uint32{0, 2} {
+		frame := make([]byte, frameHeaderLen)
+		frame[0] = frameOpen
+		binary.BigEndian.PutUint32(frame[1:], id)
+		if _, err := c2.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+		if tpe, got := readFrame(t, c2); tpe != frameReset || got != id {
+			t.Errorf("open %d answered by frame %d for %d, want a reset", id, tpe, got)
+		}
+	}
+	if n := ses.NumStreams(); n != 0 {
+		t.Errorf("%d streams accepted", n)
+	}
+}
+
+func TestMuxBothSides(t *testing.T) {
+	// reverse tunnels open streams on the server while the client opens its
+	// own, run with -race
+	client, server := muxPair(t, 0)
+	const n = 20
+	errs := make(chan error, 2*n)
+	for _, ses := range []*MuxSession{client, server} {
+		go func(ses *MuxSession) {
+			for i := 0; i < n; i++ {
+				_, err := ses.OpenStream("example.com:80")
+				errs <- err
+			}
+		}(ses)
+		go func(ses *MuxSession) {
+			for i := 0; i < n; i++ {
+				if _, err := ses.AcceptStream(); err != nil {
+					errs <- err
+				}
+			}
+		}(ses)
+	}
+	for i := 0; i < 2*n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client.NumStreams() != 2*n || server.NumStreams() != 2*n {
+		if time.Now().After(deadline) {
+			t.Fatalf("client has %d streams, server %d, want %d", client.NumStreams(), server.NumStreams(), 2*n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMuxPing(t *testing.T) {
+	client, _ := muxPair(t, 0)
+	if _, err := client.Ping(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// a peer that reads but never answers
+	c1, c2 := net.Pipe()
+	ses := NewMuxSession(c1, true, 0)
+	defer ses.Close()
+	go io.Copy(ioutil.Discard, c2)
+	start := time.Now()
+	_, err := ses.Ping(100 * time.Millisecond)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("ping = %v, want a timeout", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("ping took too long to time out")
+	}
+	ses.lock.Lock()
+	n := len(ses.pings)
+	ses.lock.Unlock()
+	if n != 0 {
+		t.Errorf("%d pings left waiting", n)
+	}
+}
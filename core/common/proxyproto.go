@@ -0,0 +1,263 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxySigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseCIDRList parses a list of cidrs or single ips.
+func ParseCIDRList(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range list {
+		n, err := parseCIDR(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseProxyProtocolVersion parses --proxy-protocol-out, v1 or v2.
+func ParseProxyProtocolVersion(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return 0, nil
+	case "v1", "1":
+		return 1, nil
+	case "v2", "2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown proxy protocol version:%s", s)
+}
+
+// proxyProtoListener reads the PROXY protocol header of connections from
+// trusted balancers, other connections are passed through untouched.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// WrapProxyProtocol enables PROXY protocol v1/v2 on ln for the sources of
+// --proxy-protocol-from.
+func WrapProxyProtocol(conf *Config, ln net.Listener) net.Listener {
+	if len(conf.ProxyProtoFrom) == 0 {
+		return ln
+	}
+	return &proxyProtoListener{Listener: ln, trusted: conf.ProxyProtoFrom}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !containsIP(l.trusted, conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn), once: &sync.Once{}}, nil
+}
+
+// proxyProtoConn reports the client address of the PROXY header as remote
+// address, the header is read on first use so Accept never blocks.
+type proxyProtoConn struct {
+	net.Conn
+	r    *bufio.Reader
+	once *sync.Once
+	src  net.Addr
+	err  error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.src, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Println("proxy protocol", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+func (c *proxyProtoConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// readProxyHeader consumes a v1 or v2 header, src is nil when there is no
+// header or it carries no address (UNKNOWN, LOCAL).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	v, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch v[0] {
+	case 'P':
+		if head, err := r.Peek(6); err != nil || string(head) != "PROXY " {
+			return nil, nil
+		}
+		return readProxyHeaderV1(r)
+	case '\r':
+		if head, err := r.Peek(len(proxySigV2)); err != nil || !bytes.Equal(head, proxySigV2) {
+			return nil, nil
+		}
+		return readProxyHeaderV2(r)
+	}
+	return nil, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// a v1 header is at most 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("bad proxy protocol v1 header")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("bad proxy protocol v1 header:%q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("bad proxy protocol v1 header:%q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 0x2 {
+		return nil, fmt.Errorf("bad proxy protocol version:%d", head[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	// LOCAL is sent by the balancer for its own health checks
+	if head[12]&0x0F == 0x0 {
+		return nil, nil
+	}
+	switch head[13] >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, errors.New("short proxy protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2:
+		if len(body) < 36 {
+			return nil, errors.New("short proxy protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// WriteProxyHeader sends a PROXY protocol header telling the peer that the
+// connection comes from src and was going to dst.
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	known := sok && dok && (s.IP.To4() != nil) == (d.IP.To4() != nil)
+	var buf []byte
+	if version == 1 {
+		switch {
+		case !known:
+			buf = []byte("PROXY UNKNOWN\r\n")
+		case s.IP.To4() != nil:
+			buf = []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port))
+		default:
+			buf = []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", s.IP.To16(), d.IP.To16(), s.Port, d.Port))
+		}
+	} else {
+		buf = append(buf, proxySigV2...)
+		var addr []byte
+		switch {
+		case !known:
+			buf = append(buf, 0x21, 0x00)
+		case s.IP.To4() != nil:
+			buf = append(buf, 0x21, 0x11)
+			addr = append(append(addr, s.IP.To4()...), d.IP.To4()...)
+		default:
+			buf = append(buf, 0x21, 0x21)
+			addr = append(append(addr, s.IP.To16()...), d.IP.To16()...)
+		}
+		if known {
+			addr = append(addr, byte(s.Port>>8), byte(s.Port), byte(d.Port>>8), byte(d.Port))
+		}
+		buf = append(buf, byte(len(addr)>>8), byte(len(addr)))
+		buf = append(buf, addr...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,236 @@
+package common
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StrategyPrimaryBackup = "primary-backup"
+	StrategyRoundRobin    = "round-robin"
+	StrategyLowestLatency = "lowest-latency"
+
+	// probeFailLimit is the number of failed probes in a row after which
+	// the sessions to a remote are given up
+	probeFailLimit = 3
+)
+
+// RemoteState is the health of one tunnel server as seen by the probes,
+// a remote is assumed alive until a probe or a dial fails.
+type RemoteState struct {
+	Addr      string
+	Alive     bool
+	Latency   time.Duration
+	LastCheck time.Time
+	LastErr   error
+	Fails     int
+}
+
+// remoteGroup is a comma separated list of tunnel servers used for one
+// PROXY action.
+type remoteGroup struct {
+	name     string
+	strategy string
+	remotes  []*RemoteState
+	next     int
+	lock     *sync.Mutex
+}
+
+var (
+	remoteGroups = make(map[string]*remoteGroup)
+	rgLock       = &sync.Mutex{}
+)
+
+func splitRemotes(remote string) []string {
+	list := make([]string, 0)
+	for _, addr := range strings.Split(remote, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			list = append(list, addr)
+		}
+	}
+	return list
+}
+
+func getRemoteGroup(conf *Config, remote string) *remoteGroup {
+	rgLock.Lock()
+	defer rgLock.Unlock()
+	if g, ok := remoteGroups[remote]; ok {
+		return g
+	}
+	g := &remoteGroup{name: remote, strategy: conf.RemoteStrategy, lock: &sync.Mutex{}}
+	for _, addr := range splitRemotes(remote) {
+		g.remotes = append(g.remotes, &RemoteState{Addr: addr, Alive: true})
+	}
+	remoteGroups[remote] = g
+	return g
+}
+
+// candidates returns the remotes in the order they should be tried, alive
+// ones by strategy first, then the dead ones as a last resort.
+func (g *remoteGroup) candidates() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	alive := make([]*RemoteState, 0, len(g.remotes))
+	dead := make([]string, 0)
+	for _, r := range g.remotes {
+		if r.Alive {
+			alive = append(alive, r)
+		} else {
+			dead = append(dead, r.Addr)
+		}
+	}
+	switch g.strategy {
+	case StrategyRoundRobin:
+		if len(alive) > 0 {
+			n := g.next % len(alive)
+			g.next++
+			alive = append(alive[n:], alive[:n]...)
+		}
+	case StrategyLowestLatency:
+		sort.SliceStable(alive, func(i, j int) bool {
+			return alive[i].Latency < alive[j].Latency
+		})
+	}
+	list := make([]string, 0, len(g.remotes))
+	for _, r := range alive {
+		list = append(list, r.Addr)
+	}
+	return append(list, dead...)
+}
+
+// update records a probe or dial result and returns the number of failures
+// in a row.
+func (g *remoteGroup) update(addr string, latency time.Duration, err error) (fails int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, r := range g.remotes {
+		if r.Addr != addr {
+			continue
+		}
+		if r.Alive && err != nil {
+			log.Println("remote", addr, "down:", err)
+		} else if !r.Alive && err == nil {
+			log.Println("remote", addr, "up")
+		}
+		r.Alive = err == nil
+		r.LastErr = err
+		r.LastCheck = time.Now()
+		if err != nil {
+			r.Fails++
+		} else {
+			r.Fails = 0
+		}
+		if err == nil && latency > 0 {
+			r.Latency = latency
+		}
+		fails = r.Fails
+	}
+	return fails
+}
+
+// pickSession returns a session to one of the servers of remote, failing
+// over to the next server when a dial fails. A success marks the server up
+// again, without probes this is how a recovered primary is used again.
+func pickSession(conf *Config, remote string) (*MuxSession, error) {
+	g := getRemoteGroup(conf, remote)
+	var lastErr error = ErrSessionClosed
+	for _, addr := range g.candidates() {
+		ses, err := pickRemoteSession(conf, addr)
+		if err == nil {
+			g.update(addr, 0, nil)
+			return ses, nil
+		}
+		if err != ErrTooManyStreams {
+			g.update(addr, 0, err)
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// probeSession returns any open session to addr, dialing one if needed.
+func probeSession(conf *Config, addr string) (*MuxSession, error) {
+	tsLock.Lock()
+	for _, ses := range tunnelSessions[addr] {
+		if !ses.IsClosed() {
+			tsLock.Unlock()
+			return ses, nil
+		}
+	}
+	tsLock.Unlock()
+	return pickRemoteSession(conf, addr)
+}
+
+func probeRemote(conf *Config, addr string) (*MuxSession, time.Duration, error) {
+	ses, err := probeSession(conf, addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt, err := ses.Ping(dialTimeout(conf))
+	return ses, rtt, err
+}
+
+// check probes every remote of the group, a lost probe only marks the
+// remote down, its session is closed after probeFailLimit in a row.
+func (g *remoteGroup) check(conf *Config) {
+	for _, r := range splitRemotes(g.name) {
+		ses, rtt, err := probeRemote(conf, r)
+		if fails := g.update(r, rtt, err); ses != nil && fails >= probeFailLimit {
+			log.Println("remote", r, "failed", fails, "probes, closing session")
+			ses.Close()
+		}
+	}
+}
+
+// StartHealthCheck probes every configured tunnel server over the tunnel
+// protocol each HealthInterval seconds until the context is done.
+func StartHealthCheck(conf *Config) {
+	if conf.HealthInterval <= 0 {
+		return
+	}
+	groups := make([]*remoteGroup, 0)
+	if conf.Remote != "" {
+		groups = append(groups, getRemoteGroup(conf, conf.Remote))
+	}
+	for _, remote := range conf.NamedRemotes {
+		groups = append(groups, getRemoteGroup(conf, remote))
+	}
+	if len(groups) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(conf.HealthInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			for _, g := range groups {
+				g.check(conf)
+			}
+			select {
+			case <-conf.Context.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func PrintRemotes() {
+	rgLock.Lock()
+	defer rgLock.Unlock()
+	for _, g := range remoteGroups {
+		g.lock.Lock()
+		for _, r := range g.remotes {
+			state := "down"
+			if r.LastCheck.IsZero() {
+				state = "unknown"
+			} else if r.Alive {
+				state = "up"
+			}
+			log.Printf("remote %s [%s] %s latency:%v checked:%v fails:%d err:%v\n", r.Addr, g.strategy, state, r.Latency, r.LastCheck.Format(time.RFC3339), r.Fails, r.LastErr)
+		}
+		g.lock.Unlock()
+	}
+}
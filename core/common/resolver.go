@@ -0,0 +1,73 @@
+package common
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+const (
+	dnsCacheTTL      = 5 * time.Minute
+	dnsFailedTTL     = 10 * time.Second
+	dnsCacheCapacity = 4096
+)
+
+var dnsCache, _ = lru.New(dnsCacheCapacity)
+
+type dnsEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// LookupIP resolves host through a cache shared by routing and direct
+// dials, failures are cached for a short time too.
+func LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if v, ok := dnsCache.Get(host); ok {
+		e := v.(*dnsEntry)
+		if time.Now().Before(e.expires) {
+			return e.ips, e.err
+		}
+		dnsCache.Remove(host)
+	}
+	ips, err := net.LookupIP(host)
+	ttl := dnsCacheTTL
+	if err != nil {
+		ttl = dnsFailedTTL
+	}
+	dnsCache.Add(host, &dnsEntry{ips: ips, err: err, expires: time.Now().Add(ttl)})
+	return ips, err
+}
+
+// ResolveTCPAddr is net.ResolveTCPAddr backed by LookupIP, ipv4 addresses
+// are preferred.
+func ResolveTCPAddr(target string) (*net.TCPAddr, error) {
+	host, sport, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	ip := ips[0]
+	for _, v := range ips {
+		if v.To4() != nil {
+			ip = v
+			break
+		}
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,249 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const reverseRetry = 10 * time.Second
+
+// Reverse maps a listen address on the tunnel server to the local target
+// its connections are forwarded to.
+type Reverse map[string]string
+
+// ParseReverse parses --reverse listen=target, a bare port listens on all
+// interfaces of the server.
+func ParseReverse(list []string) (Reverse, error) {
+	rev := make(Reverse)
+	for _, item := range list {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad reverse:%s", item)
+		}
+		listen := parts[0]
+		if _, err := strconv.Atoi(listen); err == nil {
+			listen = ":" + listen
+		}
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return nil, fmt.Errorf("bad reverse listen:%s", parts[0])
+		}
+		if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+			return nil, fmt.Errorf("bad reverse target:%s", parts[1])
+		}
+		rev[listen] = parts[1]
+	}
+	return rev, nil
+}
+
+// ReversePolicy maps a tunnel user, or * for every user, to the ports its
+// reverse tunnels may listen on.
+type ReversePolicy map[string][]portMatcher
+
+// ParseReversePorts parses --reverse-ports user=8000-8100,9000
+func ParseReversePorts(list []string) (ReversePolicy, error) {
+	policy := make(ReversePolicy)
+	for _, item := range list {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("bad reverse ports:%s", item)
+		}
+		for _, v := range strings.Split(parts[1], ",") {
+			m, err := parsePortRange(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("bad reverse ports:%s", item)
+			}
+			policy[parts[0]] = append(policy[parts[0]], m)
+		}
+	}
+	return policy, nil
+}
+
+func (p ReversePolicy) Allow(user string, port int) bool {
+	for _, key := range []string{user, "*"} {
+		for _, m := range p[key] {
+			if port >= m.from && port <= m.to {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StartReverse keeps the --reverse registrations on the remote server, they
+// are registered again when the session is lost.
+func StartReverse(conf *Config) {
+	for listen, target := range conf.Reverse {
+		go keepReverse(conf, listen, target)
+	}
+}
+
+func keepReverse(conf *Config, listen, target string) {
+	for {
+		err := registerReverse(conf, listen, target)
+		log.Println("reverse", listen, "->", target, err)
+		select {
+		case <-conf.Context.Done():
+			return
+		case <-time.After(reverseRetry):
+		}
+	}
+}
+
+func registerReverse(conf *Config, listen, target string) error {
+	ses, err := pickSession(conf, conf.Remote)
+	if err != nil {
+		return err
+	}
+	stream, err := ses.OpenListenStream(listen)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	status, addr, err := stream.WaitReply(dialTimeout(conf))
+	if err != nil {
+		return err
+	}
+	if status != StatusSuccess {
+		return &DialError{Status: status, Target: listen}
+	}
+	log.Println("reverse", addr, "on remote ->", target)
+	go func() {
+		<-conf.Context.Done()
+		stream.Close()
+	}()
+	// the server never writes on the registration, it ends with the session
+	_, err = io.Copy(ioutil.Discard, stream)
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+// acceptReverse serves the streams opened by the server of a client session.
+func acceptReverse(conf *Config, ses *MuxSession) {
+	for {
+		stream, err := ses.AcceptStream()
+		if err != nil {
+			return
+		}
+		go serveReverseStream(conf, stream)
+	}
+}
+
+func serveReverseStream(conf *Config, stream *MuxStream) {
+	acs := NewACS(stream)
+	defer acs.Close()
+	target, ok := conf.Reverse[stream.Target]
+	if stream.Kind != KindConnect || !ok {
+		log.Println("reverse stream not registered", stream.Target)
+		_ = stream.Reply(StatusDenied, "")
+		return
+	}
+	conn, err := net.DialTimeout("tcp", target, dialTimeout(conf))
+	if err != nil {
+		log.Println("reverse", stream.Target, "->", target, err)
+		_ = stream.Reply(StatusOf(newDialError(target, err)), "")
+		return
+	}
+	err = stream.Reply(StatusSuccess, conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	cAcs := NewACS(conn)
+	defer cAcs.Close()
+	go Transfer(cAcs.Open(), acs.Open(), "IN")
+	go Transfer(acs.Open(), cAcs.Open(), "OUT")
+}
+
+var (
+	reverseListeners = make(map[string]string)
+	rlLock           = &sync.Mutex{}
+)
+
+// ServeListenStream listens on the server for a reverse tunnel of user and
+// opens a stream back to the client for every accepted connection, the
+// listener lives as long as the registration stream.
+func ServeListenStream(conf *Config, ses *MuxSession, stream *MuxStream, user string) {
+	defer stream.Close()
+	listen := stream.Target
+	_, portStr, err := net.SplitHostPort(listen)
+	port, _ := strconv.Atoi(portStr)
+	if err != nil || !conf.ReversePorts.Allow(user, port) {
+		log.Println("reverse", listen, "denied for user", user)
+		_ = stream.Reply(StatusDenied, "")
+		return
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Println("reverse", listen, err)
+		_ = stream.Reply(StatusOf(newDialError(listen, err)), "")
+		return
+	}
+	defer ln.Close()
+	if err = stream.Reply(StatusSuccess, ln.Addr().String()); err != nil {
+		return
+	}
+	log.Println("reverse listen", ln.Addr(), "user", user)
+	addReverseListener(ln.Addr().String(), user)
+	defer delReverseListener(ln.Addr().String())
+	go func() {
+		io.Copy(ioutil.Discard, stream)
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("reverse", ln.Addr(), "closed")
+			return
+		}
+		go forwardReverse(conf, ses, listen, conn)
+	}
+}
+
+func forwardReverse(conf *Config, ses *MuxSession, listen string, conn net.Conn) {
+	cAcs := NewACS(conn)
+	defer cAcs.Close()
+	stream, err := ses.OpenStream(listen)
+	if err != nil {
+		log.Println("reverse", listen, err)
+		return
+	}
+	acs := NewACS(stream)
+	defer acs.Close()
+	status, _, err := stream.WaitReply(dialTimeout(conf))
+	if err != nil || status != StatusSuccess {
+		log.Println("reverse", listen, "from", conn.RemoteAddr(), "refused by client", status, err)
+		return
+	}
+	go Transfer(cAcs.Open(), acs.Open(), "IN")
+	go Transfer(acs.Open(), cAcs.Open(), "OUT")
+}
+
+func addReverseListener(addr, user string) {
+	rlLock.Lock()
+	defer rlLock.Unlock()
+	reverseListeners[addr] = user
+}
+
+func delReverseListener(addr string) {
+	rlLock.Lock()
+	defer rlLock.Unlock()
+	delete(reverseListeners, addr)
+}
+
+// PrintReverse logs the reverse tunnels listening on the server.
+func PrintReverse() {
+	rlLock.Lock()
+	defer rlLock.Unlock()
+	for addr, user := range reverseListeners {
+		log.Println("reverse", addr, "user", user)
+	}
+}
@@ -0,0 +1,401 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type ActionType int8
+
+const (
+	ActionDirect = ActionType(iota)
+	ActionProxy
+	ActionReject
+	ActionUpstream
+)
+
+// Action is what a rule does with a matched connection, Remote names the
+// tunnel server of a PROXY action or the parent proxy of an UPSTREAM action,
+// it is empty for the default one.
+type Action struct {
+	Type   ActionType
+	Remote string
+}
+
+func (a Action) String() string {
+	switch a.Type {
+	case ActionDirect:
+		return "DIRECT"
+	case ActionReject:
+		return "REJECT"
+	case ActionUpstream:
+		if a.Remote != "" {
+			return "UPSTREAM:" + a.Remote
+		}
+		return "UPSTREAM"
+	}
+	if a.Remote != "" {
+		return "PROXY:" + a.Remote
+	}
+	return "PROXY"
+}
+
+func ParseAction(s string) (a Action, err error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.EqualFold(s, "DIRECT"):
+		a.Type = ActionDirect
+	case strings.EqualFold(s, "REJECT"):
+		a.Type = ActionReject
+	case strings.EqualFold(s, "PROXY"):
+		a.Type = ActionProxy
+	case len(s) > 6 && strings.EqualFold(s[:6], "PROXY:"):
+		a.Type = ActionProxy
+		a.Remote = s[6:]
+	case strings.EqualFold(s, "UPSTREAM"):
+		a.Type = ActionUpstream
+	case len(s) > 9 && strings.EqualFold(s[:9], "UPSTREAM:"):
+		a.Type = ActionUpstream
+		a.Remote = s[9:]
+	default:
+		err = fmt.Errorf("unknown rule action:%s", s)
+	}
+	return
+}
+
+// Metadata describes the client side of a proxied connection.
+type Metadata struct {
+	Source net.Addr
+	User   string
+}
+
+func (m *Metadata) sourceIP() net.IP {
+	if m == nil {
+		return nil
+	}
+	switch a := m.Source.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+type RouteRequest struct {
+	Host   string
+	Port   int
+	Target string
+	Meta   *Metadata
+
+	resolve  bool
+	resolved bool
+	ips      []net.IP
+}
+
+// IPs returns the destination addresses, a domain is resolved once per
+// request and only when resolve is true.
+func (req *RouteRequest) IPs(resolve bool) []net.IP {
+	if ip := net.ParseIP(req.Host); ip != nil {
+		return []net.IP{ip}
+	}
+	if !resolve || !req.resolve {
+		return nil
+	}
+	if !req.resolved {
+		req.resolved = true
+		ips, err := LookupIP(GetMappedHost(req.Host))
+		if err != nil {
+			log.Println("route resolve", req.Host, err)
+		}
+		req.ips = ips
+	}
+	return req.ips
+}
+
+type Matcher interface {
+	Match(req *RouteRequest) bool
+}
+
+type Rule struct {
+	Raw     string
+	Matcher Matcher
+	Action  Action
+}
+
+type domainMatcher string
+
+func (m domainMatcher) Match(req *RouteRequest) bool {
+	return strings.EqualFold(req.Host, string(m))
+}
+
+type suffixMatcher string
+
+func (m suffixMatcher) Match(req *RouteRequest) bool {
+	host := strings.ToLower(req.Host)
+	return host == string(m) || strings.HasSuffix(host, "."+string(m))
+}
+
+type keywordMatcher string
+
+func (m keywordMatcher) Match(req *RouteRequest) bool {
+	return strings.Contains(strings.ToLower(req.Host), string(m))
+}
+
+type regexMatcher struct {
+	*regexp.Regexp
+}
+
+func (m regexMatcher) Match(req *RouteRequest) bool {
+	return m.MatchString(req.Host)
+}
+
+// legacyMatcher is a bare regex line of the old local only list, it was
+// written against host:port, so both forms are tried.
+type legacyMatcher struct {
+	*regexp.Regexp
+}
+
+func (m legacyMatcher) Match(req *RouteRequest) bool {
+	return m.MatchString(req.Target) || m.MatchString(req.Host)
+}
+
+type cidrMatcher struct {
+	*net.IPNet
+	noResolve bool
+}
+
+func (m cidrMatcher) Match(req *RouteRequest) bool {
+	for _, ip := range req.IPs(!m.noResolve) {
+		if m.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type portMatcher struct {
+	from, to int
+}
+
+func (m portMatcher) Match(req *RouteRequest) bool {
+	return req.Port >= m.from && req.Port <= m.to
+}
+
+type srcIPMatcher struct {
+	*net.IPNet
+}
+
+func (m srcIPMatcher) Match(req *RouteRequest) bool {
+	ip := req.Meta.sourceIP()
+	return ip != nil && m.Contains(ip)
+}
+
+type userMatcher string
+
+func (m userMatcher) Match(req *RouteRequest) bool {
+	return req.Meta != nil && req.Meta.User == string(m)
+}
+
+type matchAll struct{}
+
+func (matchAll) Match(req *RouteRequest) bool {
+	return true
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("bad ip:%s", s)
+		}
+		if ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+func parsePortRange(s string) (m portMatcher, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	m.from, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return
+	}
+	m.to = m.from
+	if len(parts) == 2 {
+		if m.to, err = strconv.Atoi(parts[1]); err != nil {
+			return
+		}
+	}
+	if m.from < 0 || m.to > 65535 || m.from > m.to {
+		err = fmt.Errorf("bad port range:%s", s)
+	}
+	return
+}
+
+var matcherParsers = map[string]func(value string) (Matcher, error){
+	"DOMAIN": func(v string) (Matcher, error) {
+		return domainMatcher(strings.ToLower(v)), nil
+	},
+	"DOMAIN-SUFFIX": func(v string) (Matcher, error) {
+		return suffixMatcher(strings.ToLower(strings.TrimPrefix(v, "."))), nil
+	},
+	"DOMAIN-KEYWORD": func(v string) (Matcher, error) {
+		return keywordMatcher(strings.ToLower(v)), nil
+	},
+	"REGEX": func(v string) (Matcher, error) {
+		r, err := regexp.Compile(v)
+		return regexMatcher{r}, err
+	},
+	"IP-CIDR": func(v string) (Matcher, error) {
+		n, err := parseCIDR(v)
+		return cidrMatcher{IPNet: n}, err
+	},
+	"IP-CIDR6": func(v string) (Matcher, error) {
+		n, err := parseCIDR(v)
+		if err == nil && (n.IP.To4() != nil || len(n.Mask) != net.IPv6len) {
+			err = fmt.Errorf("not an ipv6 cidr:%s", v)
+		}
+		return cidrMatcher{IPNet: n}, err
+	},
+	"DST-PORT": func(v string) (Matcher, error) {
+		return parsePortRange(v)
+	},
+	"SRC-IP": func(v string) (Matcher, error) {
+		n, err := parseCIDR(v)
+		return srcIPMatcher{n}, err
+	},
+	"USER": func(v string) (Matcher, error) {
+		return userMatcher(v), nil
+	},
+	"GEOIP": func(v string) (Matcher, error) {
+		return geoipMatcher{code: strings.ToUpper(v)}, nil
+	},
+}
+
+// ParseRule parses one rule line:
+//
+//	TYPE,VALUE,ACTION    e.g. DOMAIN-SUFFIX,qq.com,DIRECT
+//	TYPE,VALUE,ACTION,no-resolve
+//	MATCH,ACTION         matches everything
+//	REGEX                old local only line, routed DIRECT
+//
+// no-resolve stops ip rules from resolving domain targets.
+func ParseRule(line string) (*Rule, error) {
+	line = strings.TrimSpace(line)
+	parts := strings.Split(line, ",")
+	tpe := strings.ToUpper(strings.TrimSpace(parts[0]))
+	if tpe == "MATCH" {
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad rule:%s", line)
+		}
+		action, err := ParseAction(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		return &Rule{Raw: line, Matcher: matchAll{}, Action: action}, nil
+	}
+	parser, ok := matcherParsers[tpe]
+	if !ok {
+		r, err := regexp.Compile(line)
+		if err != nil {
+			return nil, err
+		}
+		return &Rule{Raw: line, Matcher: legacyMatcher{r}, Action: Action{Type: ActionDirect}}, nil
+	}
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("bad rule:%s", line)
+	}
+	noResolve := false
+	if len(parts) > 3 && strings.EqualFold(strings.TrimSpace(parts[len(parts)-1]), "no-resolve") {
+		noResolve = true
+		parts = parts[:len(parts)-1]
+	}
+	value := strings.TrimSpace(strings.Join(parts[1:len(parts)-1], ","))
+	m, err := parser(value)
+	if err != nil {
+		return nil, err
+	}
+	switch im := m.(type) {
+	case cidrMatcher:
+		im.noResolve = noResolve
+		m = im
+	case geoipMatcher:
+		im.noResolve = noResolve
+		m = im
+	}
+	action, err := ParseAction(parts[len(parts)-1])
+	if err != nil {
+		return nil, err
+	}
+	return &Rule{Raw: line, Matcher: m, Action: action}, nil
+}
+
+func newRouteRequest(conf *Config, meta *Metadata, target string) *RouteRequest {
+	req := &RouteRequest{Target: target, Meta: meta, Host: target}
+	req.resolve = conf != nil && conf.ResolveRules
+	host, port, err := net.SplitHostPort(target)
+	if err == nil {
+		req.Host = host
+		req.Port, _ = strconv.Atoi(port)
+	}
+	return req
+}
+
+// Route evaluates the rules in order, without a match the connection goes
+// through the default remote, or direct when there is none.
+func Route(conf *Config, meta *Metadata, target string) Action {
+	req := newRouteRequest(conf, meta, target)
+	// ip rules may resolve the target, match on a copy so a reload isn't
+	// held up by a slow resolver
+	lolLock.RLock()
+	list := make([]*Rule, len(rules))
+	copy(list, rules)
+	lolLock.RUnlock()
+	for _, r := range list {
+		if r.Matcher.Match(req) {
+			return r.Action
+		}
+	}
+	if conf.Remote == "" && conf.UpstreamProxy != "" {
+		return Action{Type: ActionUpstream}
+	}
+	return Action{Type: ActionProxy}
+}
+
+// RemoteAddr returns the tunnel server of a PROXY action, ok is false when
+// the connection should go direct.
+func RemoteAddr(conf *Config, action Action) (addr string, ok bool, err error) {
+	if action.Type != ActionProxy {
+		return "", false, nil
+	}
+	if action.Remote == "" {
+		return conf.Remote, conf.Remote != "", nil
+	}
+	addr, ok = conf.NamedRemotes[action.Remote]
+	if !ok {
+		return "", false, fmt.Errorf("unknown remote:%s", action.Remote)
+	}
+	return addr, true, nil
+}
+
+// ParseNamedRemotes parses name=host:port entries of --named-remote.
+func ParseNamedRemotes(list []string) (map[string]string, error) {
+	remotes := make(map[string]string)
+	for _, v := range list {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("bad named remote:%s", v)
+		}
+		remotes[kv[0]] = kv[1]
+	}
+	return remotes, nil
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	StatusSuccess         = 0x00
+	StatusGeneralFailure  = 0x01
+	StatusDenied          = 0x02
+	StatusNetUnreachable  = 0x03
+	StatusHostUnreachable = 0x04
+	StatusRefused         = 0x05
+	StatusTimeout         = 0x06
+	StatusDNSFailure      = 0x07
+)
+
+var statusText = map[byte]string{
+	StatusSuccess:         "success",
+	StatusGeneralFailure:  "general failure",
+	StatusDenied:          "denied by policy",
+	StatusNetUnreachable:  "network unreachable",
+	StatusHostUnreachable: "host unreachable",
+	StatusRefused:         "connection refused",
+	StatusTimeout:         "timeout",
+	StatusDNSFailure:      "dns lookup failure",
+}
+
+func StatusText(status byte) string {
+	if t, ok := statusText[status]; ok {
+		return t
+	}
+	return fmt.Sprintf("unknown status %d", status)
+}
+
+// DialError is returned by DialRemote when the target can not be reached,
+// either locally or as reported by the tunnel server.
+type DialError struct {
+	Status byte
+	Target string
+	Err    error
+}
+
+func (e *DialError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("dial %s: %s: %v", e.Target, StatusText(e.Status), e.Err)
+	}
+	return fmt.Sprintf("dial %s: %s", e.Target, StatusText(e.Status))
+}
+
+func (e *DialError) Timeout() bool {
+	return e.Status == StatusTimeout
+}
+
+func newDialError(target string, err error) *DialError {
+	if de, ok := err.(*DialError); ok {
+		return de
+	}
+	return &DialError{Status: StatusOf(err), Target: target, Err: err}
+}
+
+// StatusOf classifies a dial error into one of the tunnel status codes.
+func StatusOf(err error) byte {
+	if err == nil {
+		return StatusSuccess
+	}
+	var de *DialError
+	if errors.As(err, &de) {
+		return de.Status
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return StatusTimeout
+		}
+		return StatusDNSFailure
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return StatusTimeout
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return StatusRefused
+		case syscall.ENETUNREACH:
+			return StatusNetUnreachable
+		case syscall.EHOSTUNREACH:
+			return StatusHostUnreachable
+		case syscall.ETIMEDOUT:
+			return StatusTimeout
+		}
+	}
+	return StatusGeneralFailure
+}
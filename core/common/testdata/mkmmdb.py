@@ -0,0 +1,75 @@
+# Writes geoip.mmdb, a tiny GeoLite2-Country style database for the GEOIP
+# rule tests: 127.0.0.0/8 is CN, 10.0.0.0/8 only has a registered country US.
+import struct, sys
+
+
+def s(x):
+    b = x.encode()
+    return bytes([0x40 | len(b)]) + b
+
+
+def m(d):
+    out = bytes([0xE0 | len(d)])
+    for k, v in d.items():
+        out += s(k) + v
+    return out
+
+
+def u16(v):
+    return bytes([0xA2]) + struct.pack('>H', v)
+
+
+def u32(v):
+    return bytes([0xC4]) + struct.pack('>I', v)
+
+
+def u64(v):
+    return bytes([0x08, 0x02]) + struct.pack('>Q', v)
+
+
+def arr(items):
+    return bytes([len(items), 0x04]) + b''.join(items)
+
+
+records = [
+    ('127.0.0.0', 8, m({'country': m({'iso_code': s('CN')})})),
+    ('10.0.0.0', 8, m({'registered_country': m({'iso_code': s('US')})})),
+]
+
+data = b''
+nodes = [[None, None]]
+for ip, bits, rec in records:
+    prefix = [int(c) for c in ''.join(format(int(o), '08b') for o in ip.split('.'))[:bits]]
+    node = 0
+    for b in prefix[:-1]:
+        if nodes[node][b] is None:
+            nodes.append([None, None])
+            nodes[node][b] = len(nodes) - 1
+        node = nodes[node][b]
+    nodes[node][prefix[-1]] = ('data', len(data))
+    data += rec
+
+n = len(nodes)
+tree = b''
+for node in nodes:
+    for r in node:
+        if r is None:
+            v = n
+        elif isinstance(r, tuple):
+            v = n + 16 + r[1]
+        else:
+            v = r
+        tree += v.to_bytes(3, 'big')
+
+meta = m({
+    'node_count': u32(n),
+    'record_size': u16(24),
+    'ip_version': u16(4),
+    'database_type': s('GeoLite2-Country'),
+    'languages': arr([s('en')]),
+    'binary_format_major_version': u16(2),
+    'binary_format_minor_version': u16(0),
+    'build_epoch': u64(1),
+    'description': m({'en': s('go-proxy test')}),
+})
+open(sys.argv[1] if len(sys.argv) > 1 else 'geoip.mmdb', 'wb').write(tree + b'\x00' * 16 + data + b'\xab\xcd\xefMaxMind.com' + meta)
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const pinPrefix = "sha256:"
+
+var khLock = &sync.Mutex{}
+
+// SPKIPin returns the sha256 pin of the public key of cert, as printed by
+// the server on start and stored in known_hosts.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// KnownHostsFile is the trust on first use file of the client, by default
+// kept next to the cert cache.
+func KnownHostsFile(conf *Config) string {
+	if conf.KnownHosts != "" {
+		return conf.KnownHosts
+	}
+	return filepath.Join(conf.CertCache, "known_hosts")
+}
+
+// ClientTLSConfig builds the tls config used to dial remote, the server is
+// verified by --remote-ca, by --remote-pin, or else by known_hosts.
+func ClientTLSConfig(conf *Config, remote string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if conf.ClientCert != "" {
+		xcert, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{xcert}
+	}
+	switch {
+	case conf.RemoteInsecure:
+		tlsConfig.InsecureSkipVerify = true
+	case conf.RemoteCA != "":
+		pem, err := ioutil.ReadFile(conf.RemoteCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.RemoteCA)
+		}
+		tlsConfig.RootCAs = pool
+	case len(conf.RemotePins) > 0:
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			pin, err := peerPin(rawCerts)
+			if err != nil {
+				return err
+			}
+			for _, p := range conf.RemotePins {
+				if p == pin {
+					return nil
+				}
+			}
+			return fmt.Errorf("remote %s certificate pin mismatch: got %s, expected %s", remote, pin, strings.Join(conf.RemotePins, " or "))
+		}
+	default:
+		file := KnownHostsFile(conf)
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			pin, err := peerPin(rawCerts)
+			if err != nil {
+				return err
+			}
+			return checkKnownHost(file, remote, pin)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func peerPin(rawCerts [][]byte) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New("remote sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return "", err
+	}
+	return SPKIPin(cert), nil
+}
+
+// checkKnownHost trusts the first pin seen for remote and records it, later
+// connections must present the same key.
+func checkKnownHost(file, remote, pin string) error {
+	khLock.Lock()
+	defer khLock.Unlock()
+	f, err := os.Open(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if f != nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 || fields[0] != remote {
+				continue
+			}
+			if fields[1] == pin {
+				return nil
+			}
+			return fmt.Errorf("remote %s certificate changed: %s has %s, got %s; delete that line if the server key was replaced on purpose", remote, file, fields[1], pin)
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	log.Println("trust remote", remote, pin, "on first use, saved to", file)
+	_, err = fmt.Fprintf(out, "%s %s\n", remote, pin)
+	return err
+}
@@ -1,56 +1,266 @@
 package common
 
 import (
-	"crypto/tls"
-	"encoding/binary"
+	"context"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
-func DialServer(conf *Config) (ses net.Conn, err error) {
-	log.Println("Dial remote", conf.Remote)
-	ses, err = tls.Dial("tcp", conf.Remote, &tls.Config{InsecureSkipVerify: true})
+var (
+	tunnelSessions = make(map[string][]*MuxSession)
+	sessionDials   = make(map[string]*sessionDial)
+	tsLock         = &sync.Mutex{}
+)
+
+func DialServer(conf *Config, remote string) (io.ReadWriteCloser, error) {
+	log.Println("Dial remote", remote)
+	tr, err := NewTransport(conf, remote)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(conf.Context, dialTimeout(conf))
+	defer cancel()
+	ses, err := tr.Dial(ctx)
 	if err != nil {
 		log.Println("dial", err)
-		return
+		return nil, err
+	}
+	compress, err := ClientHandshake(ses, conf)
+	if err != nil {
+		log.Println("handshake", err)
+		ses.Close()
+		return nil, err
+	}
+	return WrapCompress(ses, compress), nil
+}
+
+// OpenTunnelStream opens a stream on the least loaded session to remote.
+func OpenTunnelStream(conf *Config, remote, target string) (*MuxStream, error) {
+	ses, err := pickSession(conf, remote)
+	if err != nil {
+		return nil, err
 	}
-	return
+	return ses.OpenStream(target)
 }
 
-func DialRemote(conf *Config, laddr *net.TCPAddr, target string) (conn *ACStream, err error) {
+// sessionDial is a session being dialed to one tunnel server, streams
+// waiting for a session to that server share it.
+type sessionDial struct {
+	done chan struct{}
+	err  error
+}
+
+// leastLoaded drops the closed sessions to remote and returns the least
+// loaded open one, with the number of open sessions, tsLock held.
+func leastLoaded(conf *Config, remote string) (*MuxSession, int) {
+	var best *MuxSession
+	sessions := tunnelSessions[remote]
+	alive := sessions[:0]
+	for _, ses := range sessions {
+		if ses.IsClosed() {
+			continue
+		}
+		alive = append(alive, ses)
+		n := ses.NumStreams()
+		if conf.MaxStreams > 0 && n >= conf.MaxStreams {
+			continue
+		}
+		if best == nil || n < best.NumStreams() {
+			best = ses
+		}
+	}
+	tunnelSessions[remote] = alive
+	return best, len(alive)
+}
+
+// pickRemoteSession returns the least loaded session to one tunnel server,
+// a new session is dialed only when every session is full. The dial runs
+// without tsLock so a slow server doesn't hold up the others.
+func pickRemoteSession(conf *Config, remote string) (*MuxSession, error) {
+	for {
+		tsLock.Lock()
+		best, n := leastLoaded(conf, remote)
+		if best != nil {
+			tsLock.Unlock()
+			return best, nil
+		}
+		if conf.MaxSessions > 0 && n >= conf.MaxSessions {
+			tsLock.Unlock()
+			return nil, ErrTooManyStreams
+		}
+		if d, ok := sessionDials[remote]; ok {
+			tsLock.Unlock()
+			<-d.done
+			if d.err != nil {
+				return nil, d.err
+			}
+			continue
+		}
+		d := &sessionDial{done: make(chan struct{})}
+		sessionDials[remote] = d
+		tsLock.Unlock()
+
+		conn, err := DialServer(conf, remote)
+		tsLock.Lock()
+		delete(sessionDials, remote)
+		var ses *MuxSession
+		if err == nil {
+			if _, n := leastLoaded(conf, remote); conf.MaxSessions > 0 && n >= conf.MaxSessions {
+				conn.Close()
+			} else {
+				ses = NewMuxSession(conn, true, conf.MaxStreams)
+				tunnelSessions[remote] = append(tunnelSessions[remote], ses)
+			}
+		}
+		d.err = err
+		tsLock.Unlock()
+		close(d.done)
+		if err != nil {
+			return nil, err
+		}
+		if ses != nil {
+			go acceptReverse(conf, ses)
+			return ses, nil
+		}
+	}
+}
+
+func routeAction(conf *Config, meta *Metadata, target string) (Action, error) {
+	action := Route(conf, meta, target)
+	log.Println("route", target, "=>", action)
+	if action.Type == ActionReject {
+		return action, &DialError{Status: StatusDenied, Target: target}
+	}
+	return action, nil
+}
+
+// RouteTarget applies the rules to target and returns the tunnel server to
+// use, remote is empty when target is reached directly. Only tcp connects
+// can be chained through the parent proxy, UPSTREAM is denied here.
+func RouteTarget(conf *Config, meta *Metadata, target string) (remote string, err error) {
+	action, err := routeAction(conf, meta, target)
+	if err != nil {
+		return "", err
+	}
+	if action.Type == ActionUpstream {
+		return "", &DialError{Status: StatusDenied, Target: target, Err: errors.New("upstream proxy only chains tcp connects")}
+	}
+	remote, _, err = RemoteAddr(conf, action)
+	if err != nil {
+		return "", newDialError(target, err)
+	}
+	return remote, nil
+}
+
+func mapTarget(target string) string {
 	host, port, err := net.SplitHostPort(target)
-	if err == nil {
-		host = GetMappedHost(host)
-		target = net.JoinHostPort(host, port)
+	if err != nil {
+		return target
 	}
-	raddr, err := net.ResolveTCPAddr("tcp", target)
+	return net.JoinHostPort(GetMappedHost(host), port)
+}
+
+func DialRemote(conf *Config, meta *Metadata, target string) (conn *ACStream, err error) {
+	action, err := routeAction(conf, meta, target)
+	if err != nil {
+		return nil, err
+	}
+	remote, _, err := RemoteAddr(conf, action)
 	if err != nil {
-		return
+		return nil, newDialError(target, err)
 	}
-	if conf.Remote == "" || IsLocalOnly(host) {
-		conn, err := net.DialTCP("tcp", laddr, raddr)
+	target = mapTarget(target)
+	if action.Type == ActionUpstream {
+		proxy, err := UpstreamURL(conf, action)
 		if err != nil {
-			return nil, err
+			return nil, newDialError(target, err)
+		}
+		ctx := conf.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout(conf))
+		defer cancel()
+		conn, err := dialProxy(ctx, conf, proxy, target)
+		if err != nil {
+			return nil, newDialError(target, err)
 		}
-		conn.SetNoDelay(true)
 		return NewACS(conn), nil
-	} else {
-		session, err := DialServer(conf)
+	} else if remote == "" {
+		raddr, err := ResolveTCPAddr(target)
 		if err != nil {
-			return nil, err
+			return nil, newDialError(target, err)
 		}
-		acs := NewACS(session)
-		defer acs.Close()
-		err = binary.Write(acs, binary.BigEndian, uint32(len(target)))
+		conn, err := net.DialTCP("tcp", nil, raddr)
 		if err != nil {
-			log.Println("write target", err)
-			return nil, err
+			return nil, newDialError(target, err)
+		}
+		conn.SetNoDelay(true)
+		if conf.ProxyProtoOut > 0 && meta != nil && (len(conf.ProxyProtoTo) == 0 || containsIP(conf.ProxyProtoTo, raddr)) {
+			if err = WriteProxyHeader(conn, conf.ProxyProtoOut, meta.Source, raddr); err != nil {
+				conn.Close()
+				return nil, newDialError(target, err)
+			}
 		}
-		_, err = acs.Write([]byte(target))
+		return NewACS(conn), nil
+	} else {
+		stream, err := OpenTunnelStream(conf, remote, target)
 		if err != nil {
-			log.Println("write target", err)
-			return nil, err
+			log.Println("open stream", err)
+			return nil, newDialError(target, err)
+		}
+		status, _, err := stream.WaitReply(dialTimeout(conf) + 5*time.Second)
+		if err != nil || status != StatusSuccess {
+			stream.Close()
+			if err != nil {
+				return nil, &DialError{Status: StatusOf(err), Target: target, Err: err}
+			}
+			return nil, &DialError{Status: status, Target: target}
+		}
+		return NewACS(stream), nil
+	}
+}
+
+func dialTimeout(conf *Config) time.Duration {
+	if conf.ReadTimeout > 0 {
+		return time.Duration(conf.ReadTimeout) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// DialTarget is used by the tunnel server to reach a stream target.
+func DialTarget(conf *Config, target string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", target, dialTimeout(conf))
+	if err != nil {
+		return nil, newDialError(target, err)
+	}
+	return conn, nil
+}
+
+// BoundAddr returns the local address of a direct connection or the address
+// bound by the tunnel server for a tunnel stream.
+func BoundAddr(acs *ACStream) net.Addr {
+	rel, su := callFunc(acs.Origin(), "BoundAddr")
+	if su && len(rel) > 0 && rel[0] != nil {
+		return rel[0].(net.Addr)
+	}
+	return acs.LocalAddr()
+}
+
+func PrintSessions() {
+	tsLock.Lock()
+	defer tsLock.Unlock()
+	for remote, sessions := range tunnelSessions {
+		for i, ses := range sessions {
+			if ratio, ok := CompressRatio(ses); ok {
+				log.Printf("session %s#%d %v streams:%d closed:%v compression:%.1f%%\n", remote, i, ses.RemoteAddr(), ses.NumStreams(), ses.IsClosed(), ratio*100)
+				continue
+			}
+			log.Printf("session %s#%d %v streams:%d closed:%v\n", remote, i, ses.RemoteAddr(), ses.NumStreams(), ses.IsClosed())
 		}
-		return acs.Open(), nil
 	}
 }
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Transport carries tunnel sessions between client and server, it is picked
+// by the scheme of --remote and --listen, e.g. tls://host:port.
+type Transport interface {
+	Dial(ctx context.Context) (net.Conn, error)
+	Listen() (net.Listener, error)
+}
+
+type TransportFactory func(conf *Config, u *url.URL) (Transport, error)
+
+var (
+	transports = make(map[string]TransportFactory)
+	trLock     = &sync.RWMutex{}
+)
+
+func RegisterTransport(scheme string, factory TransportFactory) {
+	trLock.Lock()
+	defer trLock.Unlock()
+	transports[scheme] = factory
+}
+
+func HasTransport(scheme string) bool {
+	trLock.RLock()
+	defer trLock.RUnlock()
+	_, ok := transports[scheme]
+	return ok
+}
+
+func ListTransports() (list []string) {
+	trLock.RLock()
+	defer trLock.RUnlock()
+	for scheme := range transports {
+		list = append(list, scheme)
+	}
+	sort.Strings(list)
+	return
+}
+
+// NewTransport returns the transport of addr, a bare host:port uses the
+// --transport scheme.
+func NewTransport(conf *Config, addr string) (Transport, error) {
+	if !strings.Contains(addr, "://") {
+		addr = conf.Transport + "://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	trLock.RLock()
+	factory, ok := transports[u.Scheme]
+	trLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transport:%s", u.Scheme)
+	}
+	return factory(conf, u)
+}
+
+func init() {
+	RegisterTransport(TransportTLS, newTLSTransport)
+	RegisterTransport(TransportTCP, newTCPTransport)
+	RegisterTransport(TransportUnix, newUnixTransport)
+}
+
+const (
+	TransportTCP  = "tcp"
+	TransportUnix = "unix"
+)
+
+// dialTCP connects to remote directly or through --remote-proxy, which
+// defaults to --upstream-proxy.
+func dialTCP(ctx context.Context, conf *Config, remote string) (net.Conn, error) {
+	raw := conf.RemoteProxy
+	if raw == "" {
+		raw = conf.UpstreamProxy
+	}
+	if raw == "" {
+		d := &net.Dialer{Timeout: dialTimeout(conf)}
+		return d.DialContext(ctx, "tcp", remote)
+	}
+	proxy, err := ParseUpstream(raw)
+	if err != nil {
+		return nil, err
+	}
+	return dialProxy(ctx, conf, proxy, remote)
+}
+
+func dialTLS(ctx context.Context, conf *Config, remote string) (*tls.Conn, error) {
+	tlsConfig, err := ClientTLSConfig(conf, remote)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialTCP(ctx, conf, remote)
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func listenTLS(conf *Config, addr string) (net.Listener, error) {
+	if conf.ServerTLSConfig == nil {
+		return nil, errors.New("server tls config not set")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(WrapProxyProtocol(conf, l), conf.ServerTLSConfig), nil
+}
+
+type tlsTransport struct {
+	conf *Config
+	addr string
+}
+
+func newTLSTransport(conf *Config, u *url.URL) (Transport, error) {
+	return &tlsTransport{conf: conf, addr: u.Host}, nil
+}
+
+func (t *tlsTransport) Dial(ctx context.Context) (net.Conn, error) {
+	return dialTLS(ctx, t.conf, t.addr)
+}
+
+func (t *tlsTransport) Listen() (net.Listener, error) {
+	return listenTLS(t.conf, t.addr)
+}
+
+// tcpTransport is the tunnel without encryption, for testing only.
+type tcpTransport struct {
+	conf *Config
+	addr string
+}
+
+func newTCPTransport(conf *Config, u *url.URL) (Transport, error) {
+	return &tcpTransport{conf: conf, addr: u.Host}, nil
+}
+
+func (t *tcpTransport) Dial(ctx context.Context) (net.Conn, error) {
+	return dialTCP(ctx, t.conf, t.addr)
+}
+
+func (t *tcpTransport) Listen() (net.Listener, error) {
+	l, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	return WrapProxyProtocol(t.conf, l), nil
+}
+
+// unixTransport is the tunnel over a local unix socket, e.g. unix:///run/gp.sock
+type unixTransport struct {
+	path string
+}
+
+func newUnixTransport(conf *Config, u *url.URL) (Transport, error) {
+	path := u.Path
+	if u.Host != "" {
+		path = u.Host + path
+	}
+	if path == "" {
+		return nil, errors.New("unix transport without socket path")
+	}
+	return &unixTransport{path: path}, nil
+}
+
+func (t *unixTransport) Dial(ctx context.Context) (net.Conn, error) {
+	d := &net.Dialer{}
+	return d.DialContext(ctx, "unix", t.path)
+}
+
+func (t *unixTransport) Listen() (net.Listener, error) {
+	if fi, err := os.Stat(t.path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(t.path)
+	}
+	return net.Listen("unix", t.path)
+}
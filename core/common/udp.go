@@ -0,0 +1,135 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+)
+
+/*
+	datagram stream packet
+	+------+----------+----------+--------+------+
+	| ATYP | DST.ADDR | DST.PORT | LENGTH | DATA |
+	+------+----------+----------+--------+------+
+	|  1   | Variable |    2     |   2    | LEN  |
+	+------+----------+----------+--------+------+
+*/
+
+const maxDatagram = 0xFFFF
+
+// WriteDatagram writes one packet to a datagram stream, addr is the
+// destination when sending and the source when answering.
+func WriteDatagram(w io.Writer, addr string, data []byte) error {
+	if len(data) > maxDatagram {
+		return errors.New("datagram too large")
+	}
+	buf, err := AppendAddr(make([]byte, 0, len(data)+32), addr)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, byte(len(data)>>8), byte(len(data)))
+	buf = append(buf, data...)
+	_, err = w.Write(buf)
+	return err
+}
+
+func ReadDatagram(r io.Reader) (addr string, data []byte, err error) {
+	addr, err = ReadAddr(r)
+	if err != nil {
+		return
+	}
+	var l uint16
+	err = binary.Read(r, binary.BigEndian, &l)
+	if err != nil {
+		return
+	}
+	data = make([]byte, l)
+	_, err = io.ReadFull(r, data)
+	return
+}
+
+// OpenTunnelUDP opens a datagram stream, packets written to it are relayed
+// by the tunnel server remote.
+func OpenTunnelUDP(conf *Config, remote string) (*MuxStream, error) {
+	ses, err := pickSession(conf, remote)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := ses.OpenDatagramStream()
+	if err != nil {
+		return nil, err
+	}
+	status, _, err := stream.WaitReply(dialTimeout(conf))
+	if err != nil || status != StatusSuccess {
+		stream.Close()
+		if err != nil {
+			return nil, &DialError{Status: StatusOf(err), Target: "udp", Err: err}
+		}
+		return nil, &DialError{Status: status, Target: "udp"}
+	}
+	return stream, nil
+}
+
+// ServeDatagramStream relays the packets of a datagram stream through a
+// local udp socket until the stream is closed.
+func ServeDatagramStream(conf *Config, stream *MuxStream) {
+	defer stream.Close()
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Println(err)
+		_ = stream.Reply(StatusOf(err), "")
+		return
+	}
+	defer pc.Close()
+	err = stream.Reply(StatusSuccess, pc.LocalAddr().String())
+	if err != nil {
+		return
+	}
+	go func() {
+		defer stream.CloseWrite()
+		buf := make([]byte, maxDatagram)
+		for {
+			n, from, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			packet := &bytes.Buffer{}
+			if err := WriteDatagram(packet, from.String(), buf[:n]); err != nil {
+				log.Println(err)
+				continue
+			}
+			if _, err := stream.Write(packet.Bytes()); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		addr, data, err := ReadDatagram(stream)
+		if err != nil {
+			if err != io.EOF && err != ErrStreamReset {
+				log.Println("udp stream", err)
+			}
+			return
+		}
+		raddr, err := ResolveUDPAddr(addr)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		_, err = pc.WriteToUDP(data, raddr)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func ResolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		addr = net.JoinHostPort(GetMappedHost(host), port)
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
@@ -0,0 +1,280 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	TransportTLS = "tls"
+	TransportWS  = "ws"
+	TransportWSS = "wss"
+
+	wsBufferSize = 32 * 1024
+)
+
+const decoyPage = `<!DOCTYPE html>
+<html><head><title>Welcome</title></head>
+<body><h1>It works!</h1></body></html>
+`
+
+// wsConn carries the tunnel as binary websocket messages.
+type wsConn struct {
+	ws    *websocket.Conn
+	r     io.Reader
+	wlock *sync.Mutex
+	state *tls.ConnectionState
+}
+
+func newWSConn(ws *websocket.Conn, state *tls.ConnectionState) *wsConn {
+	return &wsConn{ws: ws, wlock: &sync.Mutex{}, state: state}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			tpe, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if tpe != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.wlock.Lock()
+	_ = c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.wlock.Unlock()
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// ConnectionState exposes the tls state of the upgraded request, so the
+// server can read the client certificate.
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	if c.state == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.state
+}
+
+// wsListener accepts tunnel connections from websocket upgrades on path and
+// serves a decoy page for every other request. With --client-ca an upgrade
+// without a verified client certificate gets the decoy too.
+type wsListener struct {
+	ln     net.Listener
+	conns  chan net.Conn
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func listenWebSocket(conf *Config, ln net.Listener, path string) net.Listener {
+	wl := &wsListener{
+		ln:     ln,
+		conns:  make(chan net.Conn, acceptBacklog),
+		closed: make(chan struct{}),
+		once:   &sync.Once{},
+	}
+	upgrader := &websocket.Upgrader{ReadBufferSize: wsBufferSize, WriteBufferSize: wsBufferSize}
+	decoy := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, decoyPage)
+	}))
+	if conf.DecoyDir != "" {
+		decoy = http.FileServer(http.Dir(conf.DecoyDir))
+	}
+	needCert := conf.ClientCA != ""
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path || !websocket.IsWebSocketUpgrade(r) || needCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+				decoy.ServeHTTP(w, r)
+				return
+			}
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				log.Println("websocket upgrade", r.RemoteAddr, err)
+				return
+			}
+			select {
+			case wl.conns <- newWSConn(ws, r.TLS):
+			case <-wl.closed:
+				ws.Close()
+			}
+		}),
+		ReadHeaderTimeout: dialTimeout(conf),
+		ErrorLog:          log.New(ioutil.Discard, "", 0),
+	}
+	go func() {
+		err := server.Serve(ln)
+		log.Println("websocket listener", err)
+		wl.Close()
+	}()
+	return wl
+}
+
+func (wl *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-wl.conns:
+		return c, nil
+	case <-wl.closed:
+		return nil, errors.New("websocket listener closed")
+	}
+}
+
+func (wl *wsListener) Close() error {
+	wl.once.Do(func() {
+		close(wl.closed)
+		wl.ln.Close()
+	})
+	return nil
+}
+
+func (wl *wsListener) Addr() net.Addr {
+	return wl.ln.Addr()
+}
+
+type wsTransport struct {
+	conf   *Config
+	addr   string
+	path   string
+	secure bool
+}
+
+// newWSTransport serves ws://host:port/path, or wss:// over tls, the path
+// defaults to --ws-path.
+func newWSTransport(conf *Config, u *url.URL) (Transport, error) {
+	path := u.Path
+	if path == "" {
+		path = conf.WSPath
+	}
+	return &wsTransport{conf: conf, addr: u.Host, path: path, secure: u.Scheme == TransportWSS}, nil
+}
+
+// Dial opens the tunnel as a websocket upgrade, tls is done by NetDial so
+// the dialer always sees a ws url.
+func (t *wsTransport) Dial(ctx context.Context) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			if t.secure {
+				return dialTLS(ctx, t.conf, t.addr)
+			}
+			return dialTCP(ctx, t.conf, t.addr)
+		},
+		HandshakeTimeout: dialTimeout(t.conf),
+		ReadBufferSize:   wsBufferSize,
+		WriteBufferSize:  wsBufferSize,
+	}
+	u := url.URL{Scheme: "ws", Host: t.addr, Path: t.path}
+	ws, resp, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		if t.secure {
+			u.Scheme = TransportWSS
+		}
+		if resp != nil {
+			return nil, fmt.Errorf("websocket %s: %s", u.String(), resp.Status)
+		}
+		return nil, err
+	}
+	return newWSConn(ws, nil), nil
+}
+
+func (t *wsTransport) Listen() (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if t.secure {
+		l, err = listenWSS(t.conf, t.addr)
+	} else {
+		l, err = net.Listen("tcp", t.addr)
+		if err == nil {
+			l = WrapProxyProtocol(t.conf, l)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Println("websocket transport on", t.path)
+	return listenWebSocket(t.conf, l, t.path), nil
+}
+
+// listenWSS is listenTLS with the client certificate made optional, so a
+// browser without one still gets the decoy page instead of a failed
+// handshake.
+func listenWSS(conf *Config, addr string) (net.Listener, error) {
+	tlsConfig := conf.ServerTLSConfig
+	if tlsConfig == nil {
+		return nil, errors.New("server tls config not set")
+	}
+	if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(WrapProxyProtocol(conf, l), tlsConfig), nil
+}
+
+func init() {
+	RegisterTransport(TransportWS, newWSTransport)
+	RegisterTransport(TransportWSS, newWSTransport)
+}
@@ -0,0 +1,228 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muyuballs/go-proxy/core/common"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	proxyRealm    = "go-proxy"
+	proxyUserKey  = "proxyUser"
+	nonceLifetime = 5 * time.Minute
+)
+
+var (
+	nonceKey = make([]byte, 32)
+	// nonceCounts holds the last nc seen for each nonce still in use
+	nonceCounts = make(map[string]nonceCount)
+	ncLock      = &sync.Mutex{}
+	ncPruned    = time.Now()
+)
+
+type nonceCount struct {
+	nc     uint64
+	issued time.Time
+}
+
+func init() {
+	_, _ = rand.Read(nonceKey)
+}
+
+func proxyUser(ctx *fasthttp.RequestCtx) string {
+	user, _ := ctx.UserValue(proxyUserKey).(string)
+	return user
+}
+
+// checkProxyAuth verifies Proxy-Authorization against the users file shared
+// with socks5, it answers 407 and returns false when the client must retry.
+func checkProxyAuth(ctx *fasthttp.RequestCtx) bool {
+	a := common.GetAuthenticator()
+	if a == nil {
+		return true
+	}
+	auth := string(ctx.Request.Header.Peek("Proxy-Authorization"))
+	ctx.Request.Header.Del("Proxy-Authorization")
+	var user string
+	var ok, stale bool
+	scheme, cred := auth, ""
+	if i := strings.Index(auth, " "); i >= 0 {
+		scheme, cred = auth[:i], auth[i+1:]
+	}
+	switch {
+	case strings.EqualFold(scheme, "Basic"):
+		user, ok = checkBasic(a, cred)
+	case strings.EqualFold(scheme, "Digest"):
+		user, ok, stale = checkDigest(a, ctx, cred)
+	}
+	if ok {
+		ctx.SetUserValue(proxyUserKey, user)
+		return true
+	}
+	if auth != "" {
+		log.Println("http proxy authentication failed", ctx.RemoteAddr(), user)
+	}
+	// Error resets the response, so the challenges go after it
+	ctx.Error("Proxy Authentication Required", fasthttp.StatusProxyAuthRequired)
+	ctx.Response.Header.Add("Proxy-Authenticate", fmt.Sprintf(`Basic realm="%s"`, proxyRealm))
+	if _, digest := a.(common.PasswordSource); digest {
+		ctx.Response.Header.Add("Proxy-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s", stale=%v`,
+			proxyRealm, newNonce(), stale))
+	}
+	return false
+}
+
+func checkBasic(a common.Authenticator, cred string) (string, bool) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+	if err != nil {
+		return "", false
+	}
+	i := strings.Index(string(raw), ":")
+	if i < 0 {
+		return "", false
+	}
+	user, pass := string(raw[:i]), string(raw[i+1:])
+	return user, a.Authenticate(user, pass)
+}
+
+// newNonce signs the issue time and a random part, so a nonce is checked
+// without server side state, only its last nc is kept until it expires.
+func newNonce() string {
+	salt := make([]byte, 8)
+	_, _ = rand.Read(salt)
+	ts := strconv.FormatInt(time.Now().Unix(), 16) + "-" + hex.EncodeToString(salt)
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write([]byte(ts))
+	return ts + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkNonce(nonce string) (valid, stale bool, issued time.Time) {
+	i := strings.Index(nonce, ".")
+	if i < 0 {
+		return
+	}
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write([]byte(nonce[:i]))
+	if !hmac.Equal([]byte(nonce[i+1:]), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return
+	}
+	ts, err := strconv.ParseInt(strings.SplitN(nonce[:i], "-", 2)[0], 16, 64)
+	if err != nil {
+		return
+	}
+	issued = time.Unix(ts, 0)
+	if time.Since(issued) > nonceLifetime {
+		return false, true, issued
+	}
+	return true, false, issued
+}
+
+// countNonce records nc for nonce, it fails when nc did not increase, so a
+// captured response can not be replayed.
+func countNonce(nonce string, issued time.Time, nc uint64) bool {
+	ncLock.Lock()
+	defer ncLock.Unlock()
+	if time.Since(ncPruned) > nonceLifetime {
+		for k, c := range nonceCounts {
+			if time.Since(c.issued) > nonceLifetime {
+				delete(nonceCounts, k)
+			}
+		}
+		ncPruned = time.Now()
+	}
+	if c, ok := nonceCounts[nonce]; ok && nc <= c.nc {
+		return false
+	}
+	nonceCounts[nonce] = nonceCount{nc: nc, issued: issued}
+	return true
+}
+
+func parseDigestParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				break
+			}
+			val, s = s[1:end+1], s[end+2:]
+		} else {
+			end := strings.Index(s, ",")
+			if end < 0 {
+				end = len(s)
+			}
+			val, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		params[key] = val
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// digestURI reports whether uri is the request target the client sent, the
+// authority for CONNECT. Clients like curl send only the path and query of
+// an absolute target.
+func digestURI(ctx *fasthttp.RequestCtx, uri string) bool {
+	if uri == string(ctx.RequestURI()) {
+		return true
+	}
+	if ctx.IsConnect() {
+		return uri == string(ctx.Host())
+	}
+	return uri == string(ctx.URI().RequestURI())
+}
+
+// checkDigest verifies an RFC 7616 MD5 response with qop=auth, only users
+// with plain passwords can use it.
+func checkDigest(a common.Authenticator, ctx *fasthttp.RequestCtx, cred string) (user string, ok, stale bool) {
+	ps, isPS := a.(common.PasswordSource)
+	if !isPS {
+		return "", false, false
+	}
+	p := parseDigestParams(cred)
+	user = p["username"]
+	pass, found := ps.Password(user)
+	if !found || p["realm"] != proxyRealm || p["qop"] != "auth" || !digestURI(ctx, p["uri"]) {
+		return user, false, false
+	}
+	nc, err := strconv.ParseUint(p["nc"], 16, 64)
+	if err != nil {
+		return user, false, false
+	}
+	valid, stale, issued := checkNonce(p["nonce"])
+	if !valid {
+		return user, false, stale
+	}
+	ha1 := md5Hex(user + ":" + proxyRealm + ":" + pass)
+	ha2 := md5Hex(string(ctx.Method()) + ":" + p["uri"])
+	expected := md5Hex(strings.Join([]string{ha1, p["nonce"], p["nc"], p["cnonce"], "auth", ha2}, ":"))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(p["response"])) != 1 {
+		return user, false, false
+	}
+	return user, countNonce(p["nonce"], issued, nc), false
+}
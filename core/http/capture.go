@@ -0,0 +1,132 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/muyuballs/go-proxy/core/common"
+)
+
+// bodyCapture keeps the first --capture-body bytes of a body for the session
+// log, a larger body is spilled whole to a file in --session-cache-dir.
+type bodyCapture struct {
+	limit int
+	buf   []byte
+	size  int64
+	path  string
+	file  *os.File
+}
+
+func newBodyCapture(conf *common.Config, sessionInfo *SessionInfo, suffix string) *bodyCapture {
+	if conf.CaptureBody <= 0 {
+		return nil
+	}
+	c := &bodyCapture{limit: conf.CaptureBody}
+	if conf.SessionCacheDir != "" {
+		c.path = filepath.Join(conf.SessionCacheDir, sessionInfo.Sid) + suffix
+	}
+	return c
+}
+
+// Write never fails, capturing must not break the proxied stream.
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	if c.file == nil && c.path != "" && len(c.buf)+len(p) > c.limit {
+		f, err := os.Create(c.path)
+		if err != nil {
+			log.Println("capture body", err)
+			c.path = ""
+		} else if _, err = f.Write(c.buf); err != nil {
+			log.Println("capture body", err)
+			f.Close()
+			c.path = ""
+		} else {
+			c.file = f
+		}
+	}
+	if c.file != nil {
+		if _, err := c.file.Write(p); err != nil {
+			log.Println("capture body", err)
+			c.file.Close()
+			c.file = nil
+			c.path = ""
+		}
+	}
+	if n := c.limit - len(c.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		c.buf = append(c.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// finish returns the captured body decoded for display, the spill file and
+// whether the body is incomplete.
+func (c *bodyCapture) finish(encoding string) (body []byte, file string, truncated bool) {
+	if c.file != nil {
+		c.file.Close()
+		file = c.path
+	}
+	truncated = c.size > int64(len(c.buf))
+	body = c.buf
+	if decoded, more, ok := decodeBody(encoding, c.buf, c.limit); ok {
+		body = decoded
+		truncated = truncated || more
+	}
+	return body, file, truncated
+}
+
+// decodeBody undoes gzip, deflate or br content coding of data, a cut off
+// body decodes as far as it goes.
+func decodeBody(encoding string, data []byte, limit int) (body []byte, more bool, ok bool) {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		// deflate is meant to be zlib wrapped, some servers send it raw
+		if r, err = zlib.NewReader(bytes.NewReader(data)); err != nil {
+			r, err = flate.NewReader(bytes.NewReader(data)), nil
+		}
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(data))
+	default:
+		return nil, false, false
+	}
+	if err != nil {
+		return nil, false, false
+	}
+	body, err = ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if len(body) == 0 && err != nil {
+		return nil, false, false
+	}
+	if len(body) > limit {
+		return body[:limit], true, true
+	}
+	return body, false, true
+}
+
+// captureRequest records the request body, fasthttp has it in memory already.
+func captureRequest(conf *common.Config, sessionInfo *SessionInfo, body []byte, encoding string) {
+	c := newBodyCapture(conf, sessionInfo, ".req.body")
+	if c == nil || len(body) == 0 {
+		return
+	}
+	c.Write(body)
+	data, file, truncated := c.finish(encoding)
+	sessionInfo.update(func() {
+		info := sessionInfo.RequestInfo
+		info.Body, info.BodyFile, info.BodyTruncated = data, file, truncated
+	})
+}
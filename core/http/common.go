@@ -1,32 +1,92 @@
 package http
 
 import (
-	"bufio"
 	"github.com/muyuballs/go-proxy/core/common"
 	"github.com/valyala/fasthttp"
 	"io"
 	"log"
 	"net"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	HopByHops = []string{"Proxy-Connection", "Connection", "Proxy-Authenticate", "Keep-Alive"}
+	HopByHops = []string{"Proxy-Connection", "Connection", "Proxy-Authenticate", "Proxy-Authorization", "Keep-Alive"}
 )
 
 func trimRequestHeader(ctx *fasthttp.RequestCtx) {
-	reqHeader := ctx.Request.Header
+	reqHeader := &ctx.Request.Header
 	for _, h := range HopByHops {
 		reqHeader.Del(h)
 	}
-	reqHeader.SetConnectionClose()
-	ctx.Request.Header = reqHeader
+	// the client already got its 100 Continue and the body was read
+	reqHeader.Del("Expect")
+	reqHeader.ResetConnectionClose()
 }
 
-func copyHttpPayload(ctx *fasthttp.RequestCtx, sessionInfo *SessionInfo, rconn *common.ACStream, conf *common.Config) {
+func dialErrorStatus(err error) int {
+	switch common.StatusOf(err) {
+	case common.StatusTimeout:
+		return fasthttp.StatusGatewayTimeout
+	case common.StatusDenied:
+		return fasthttp.StatusForbidden
+	}
+	return fasthttp.StatusBadGateway
+}
+
+func connMetadata(ctx *fasthttp.RequestCtx) *common.Metadata {
+	return &common.Metadata{Source: ctx.RemoteAddr(), User: proxyUser(ctx)}
+}
+
+// sendRequest writes the request and reads the response header. A pooled
+// connection closed by the upstream meanwhile is replaced once, when the
+// request is safe to send again and the upstream sent nothing back.
+func sendRequest(ctx *fasthttp.RequestCtx, up *upstream, rconn *common.ACStream, reused bool) (*common.ACStream, error) {
+	_, err := ctx.Request.WriteTo(rconn)
+	rconn.Flush()
+	answered := false
+	if err == nil {
+		if _, err = rconn.Reader().Peek(1); err == nil {
+			answered = true
+			err = readResponseHeader(ctx, rconn.Reader())
+		}
+	}
+	if err != nil && reused && !answered && retryable(&ctx.Request) {
+		rconn.Close()
+		rconn, err = up.dial()
+		if err != nil {
+			return nil, err
+		}
+		return sendRequest(ctx, up, rconn, false)
+	}
+	if err != nil {
+		rconn.Close()
+		return nil, err
+	}
+	return rconn, nil
+}
+
+// retryable tells if a request may reach the upstream twice, only
+// idempotent methods without a body are.
+func retryable(req *fasthttp.Request) bool {
+	switch string(req.Header.Method()) {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		return false
+	}
+	return !req.IsBodyStream() && len(req.Body()) == 0
+}
+
+func copyHttpPayload(ctx *fasthttp.RequestCtx, sessionInfo *SessionInfo, conf *common.Config, up *upstream) {
+	rconn, reused, err := up.get(conf, &ctx.Request)
+	if err != nil {
+		log.Println(err)
+		ctx.Error(err.Error(), dialErrorStatus(err))
+		sessionInfo.SessionDone()
+		return
+	}
 	var sessionReqCache = ""
 	var sessionRespCache = ""
 
@@ -42,86 +102,93 @@ func copyHttpPayload(ctx *fasthttp.RequestCtx, sessionInfo *SessionInfo, rconn *
 			log.Println(err)
 			ctx.Error(err.Error(), fasthttp.StatusServiceUnavailable)
 			sessionInfo.SessionDone()
+			rconn.Close()
 			return
 		}
 		rconn.Destroy()
 		rconn = common.NewACS(jrw)
 	}
-	defer func() {
-		_ = rconn.Close()
-	}()
-	_, _ = ctx.Request.WriteTo(rconn)
-	rconn.Flush()
-	err := ctx.Response.Header.Read(rconn.Reader())
+	captureRequest(conf, sessionInfo, ctx.Request.Body(), string(ctx.Request.Header.Peek("Content-Encoding")))
+	rconn, err = sendRequest(ctx, up, rconn, reused)
 	if err != nil {
-		ctx.Error(err.Error(), fasthttp.StatusServiceUnavailable)
+		ctx.Error(err.Error(), dialErrorStatus(err))
 		sessionInfo.SessionDone()
 		return
 	}
-	sessionInfo.ResponseInfo = &ResponseInfo{
+	version := "HTTP/1.1"
+	if !ctx.Response.Header.IsHTTP11() {
+		version = "HTTP/1.0"
+	}
+	respInfo := &ResponseInfo{
 		Status:      ctx.Response.StatusCode(),
-		Version:     "HTTP/1.1",
+		Version:     version,
 		Message:     fasthttp.StatusMessage(ctx.Response.StatusCode()),
 		BodySize:    ctx.Response.Header.ContentLength(),
 		ContextType: string(ctx.Response.Header.ContentType()),
 		Headers:     make(map[string]string),
 	}
 	ctx.Response.Header.VisitAll(func(key, value []byte) {
-		sessionInfo.ResponseInfo.Headers[string(key)] = string(value)
+		respInfo.Headers[string(key)] = string(value)
+	})
+	sessionInfo.update(func() {
+		sessionInfo.ResponseInfo = respInfo
 	})
 	cl := ctx.Response.Header.ContentLength()
+	encoding := string(ctx.Response.Header.Peek("Content-Encoding"))
+	body := responseFraming(ctx)
+	keepAlive := !ctx.Response.Header.ConnectionClose() && body != framingEOF && ctx.Response.StatusCode() != fasthttp.StatusSwitchingProtocols
+	if body == framingNone && string(ctx.Response.Header.Peek("Transfer-Encoding")) == "identity" {
+		// fasthttp took the missing length of a HEAD response as a body up to close
+		ctx.Response.Header.Del("Transfer-Encoding")
+		keepAlive = false
+	}
 	for _, h := range HopByHops {
 		ctx.Response.Header.Del(h)
 	}
+	ctx.Response.Header.ResetConnectionClose()
 	startTime := time.Now()
 	var copySize int64
 	var copyErr error
-	defer func() {
+	capture := newBodyCapture(conf, sessionInfo, ".resp.body")
+	release := func(reuse bool) {
 		cost := time.Since(startTime)
 		log.Printf("%v %v %v %v/s %v --> %v\n", "IN", copySize, common.FormatNS(float64(copySize)), common.FormatNS(float64(copySize)/cost.Seconds()), cost, copyErr)
+		if capture != nil && copySize > 0 {
+			data, file, truncated := capture.finish(encoding)
+			sessionInfo.update(func() {
+				respInfo.Body, respInfo.BodyFile, respInfo.BodyTruncated = data, file, truncated
+			})
+		}
 		sessionInfo.SessionDone()
-	}()
-	switch cl {
-	case -1: //chunk
-		xrconn := rconn.Open()
-		ctx.SetConnectionClose()
-		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
-			defer func() {
-				_ = xrconn.Close()
-				_ = w.Flush()
-			}()
-			for {
-				data, _, err := xrconn.ReadLine()
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				if strings.TrimSpace(string(data)) == "0" {
-					break
-				}
-				cs, err := strconv.ParseInt(string(data), 16, 32)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				cs, copyErr := io.CopyN(w, xrconn, cs)
-				if copyErr != nil {
-					return
-				}
-				copySize += cs
-				_, err = xrconn.Discard(2)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-			}
-		})
-	case -2: //EOF
-		ctx.SetBodyStream(rconn.Open(), -1)
-	case 0:
-		return
-	default: //Fix len
-		ctx.SetBodyStream(rconn.Open(), cl)
+		if reuse && keepAlive {
+			upstreamPool.put(conf, up.key, rconn)
+		} else {
+			rconn.Close()
+		}
+	}
+	switch body {
+	case framingNone:
+		if ctx.Request.Header.IsHead() {
+			ctx.Response.SkipBody = true
+		}
+		release(true)
+	case framingLength:
+		ctx.SetBodyStream(&bodyReader{r: rconn, remain: int64(cl), count: &copySize, capture: capture, release: release, once: &sync.Once{}}, cl)
+	default:
+		br := &bodyReader{r: rconn, remain: -1, count: &copySize, capture: capture, release: release, once: &sync.Once{}}
+		var trailer []byte
+		if body == framingChunked {
+			br.eof = true
+			br.r = &chunkedReader{r: rconn.Reader(), onTrailer: func(t []byte) {
+				fields := parseTrailer(t)
+				sessionInfo.update(func() {
+					respInfo.Trailers = fields
+				})
+				trailer = t
+			}}
+		}
+		copyErr = sendBody(ctx, br, func() []byte { return trailer })
+		br.Close()
 	}
 }
 
@@ -131,6 +198,7 @@ func buildSessionInfo(conf *common.Config, ctx *fasthttp.RequestCtx) *SessionInf
 		sessionInfo.RemoteAddr = taddr.IP.String()
 		sessionInfo.RemotePort = taddr.Port
 	}
+	sessionInfo.User = proxyUser(ctx)
 	sessionInfo.RequestInfo = &RequestInfo{
 		Host:     string(ctx.Host()),
 		Method:   string(ctx.Method()),
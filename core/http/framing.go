@@ -0,0 +1,282 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/muyuballs/go-proxy/core/common"
+	"github.com/valyala/fasthttp"
+)
+
+const maxTrailerSize = 16 << 10
+
+// framing tells how the body of an upstream response is delimited,
+// RFC 7230 section 3.3.3.
+type framing int
+
+const (
+	framingNone framing = iota
+	framingLength
+	framingChunked
+	framingEOF
+)
+
+func responseFraming(ctx *fasthttp.RequestCtx) framing {
+	code := ctx.Response.StatusCode()
+	if ctx.Request.Header.IsHead() || (code >= 100 && code < 200) || code == fasthttp.StatusNoContent || code == fasthttp.StatusNotModified {
+		return framingNone
+	}
+	switch cl := ctx.Response.Header.ContentLength(); {
+	case cl == -1:
+		return framingChunked
+	case cl == -2:
+		return framingEOF
+	case cl == 0:
+		return framingNone
+	}
+	return framingLength
+}
+
+// readResponseHeader skips interim responses like 100 Continue or
+// 103 Early Hints, 101 is final as the connection changes protocol.
+func readResponseHeader(ctx *fasthttp.RequestCtx, r *bufio.Reader) error {
+	for {
+		if err := ctx.Response.Header.Read(r); err != nil {
+			return err
+		}
+		code := ctx.Response.StatusCode()
+		if code < 100 || code >= 200 || code == fasthttp.StatusSwitchingProtocols {
+			return nil
+		}
+	}
+}
+
+// chunkedReader decodes a chunked body, chunk extensions are ignored and the
+// trailer is handed to onTrailer before io.EOF.
+type chunkedReader struct {
+	r         *bufio.Reader
+	n         int64
+	started   bool
+	err       error
+	onTrailer func(trailer []byte)
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.n == 0 {
+		if cr.err = cr.nextChunk(); cr.err != nil {
+			return 0, cr.err
+		}
+	}
+	if int64(len(p)) > cr.n {
+		p = p[:cr.n]
+	}
+	n, err := cr.r.Read(p)
+	cr.n -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	cr.err = err
+	return n, err
+}
+
+func (cr *chunkedReader) nextChunk() error {
+	if cr.started {
+		line, err := readChunkLine(cr.r)
+		if err != nil {
+			return err
+		}
+		if len(line) != 0 {
+			return errors.New("bad chunk end")
+		}
+	}
+	cr.started = true
+	line, err := readChunkLine(cr.r)
+	if err != nil {
+		return err
+	}
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	size, err := strconv.ParseInt(string(bytes.TrimRight(line, " \t")), 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("bad chunk size:%q", line)
+	}
+	if size > 0 {
+		cr.n = size
+		return nil
+	}
+	trailer, err := readTrailer(cr.r)
+	if err != nil {
+		return err
+	}
+	if cr.onTrailer != nil && len(trailer) > 0 {
+		cr.onTrailer(trailer)
+	}
+	return io.EOF
+}
+
+// readTrailer reads the fields after the last chunk up to the empty line,
+// the framing fields are dropped.
+func readTrailer(r *bufio.Reader) ([]byte, error) {
+	var trailer []byte
+	for {
+		line, err := readChunkLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			return trailer, nil
+		}
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("bad trailer:%q", line)
+		}
+		switch string(bytes.ToLower(bytes.TrimSpace(line[:i]))) {
+		case "content-length", "transfer-encoding", "trailer":
+			continue
+		}
+		if len(trailer)+len(line) > maxTrailerSize {
+			return nil, errors.New("trailer too large")
+		}
+		trailer = append(append(trailer, line...), '\r', '\n')
+	}
+}
+
+// readChunkLine returns a line without its CRLF, a bare LF is accepted.
+func readChunkLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errors.New("chunk line too long")
+	}
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// clientConn is the connection of a proxy client. Writes go through the
+// small ACStream buffer at once, so a kept-alive client gets the tail of a
+// response without waiting for close.
+type clientConn struct {
+	*common.ACStream
+	// sent is set once the handler wrote the whole response itself, what
+	// fasthttp writes for that request afterwards is dropped
+	sent bool
+}
+
+func (c *clientConn) Write(p []byte) (n int, err error) {
+	if c.sent {
+		return len(p), nil
+	}
+	n, err = c.ACStream.Write(p)
+	c.ACStream.Flush()
+	return n, err
+}
+
+// startRequest is called first by the handlers, fasthttp has written the
+// response to the previous request by then.
+func startRequest(ctx *fasthttp.RequestCtx) {
+	if c, ok := ctx.Conn().(*clientConn); ok {
+		c.sent = false
+	}
+}
+
+// sendBody writes the head and a body ending with its last chunk or the
+// close, fasthttp can send neither trailers nor a body up to the close. An
+// http/1.0 client gets the body up to the close, others get it chunked with
+// the trailer returned by trailer once body is read.
+func sendBody(ctx *fasthttp.RequestCtx, body io.Reader, trailer func() []byte) error {
+	c, ok := ctx.Conn().(*clientConn)
+	if !ok {
+		ctx.SetConnectionClose()
+		return errors.New("not a proxy client connection")
+	}
+	defer func() {
+		c.sent = true
+	}()
+	h := &ctx.Response.Header
+	// the framing fasthttp read from the upstream is replaced by ours
+	h.Del("Transfer-Encoding")
+	h.Del("Content-Length")
+	chunked := ctx.Request.Header.IsHTTP11()
+	if chunked {
+		h.Add("Transfer-Encoding", "chunked")
+	}
+	if !chunked || ctx.Request.Header.ConnectionClose() {
+		h.SetConnectionClose()
+	}
+	w := c.ACStream
+	if _, err := w.Write(h.Header()); err != nil {
+		ctx.SetConnectionClose()
+		return err
+	}
+	buf := make([]byte, 16<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if werr := writeChunk(w, buf[:n], chunked); werr != nil {
+				ctx.SetConnectionClose()
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// no last chunk, the client sees the body cut short
+			ctx.SetConnectionClose()
+			return err
+		}
+	}
+	if !chunked {
+		return nil
+	}
+	last := append([]byte("0\r\n"), trailer()...)
+	if _, err := w.Write(append(last, '\r', '\n')); err != nil {
+		ctx.SetConnectionClose()
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// writeChunk sends p as one chunk, or as it is to an http/1.0 client.
+func writeChunk(w *common.ACStream, p []byte, chunked bool) (err error) {
+	defer w.Flush()
+	if !chunked {
+		_, err = w.Write(p)
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "%x\r\n", len(p)); err != nil {
+		return err
+	}
+	if _, err = w.Write(p); err != nil {
+		return err
+	}
+	_, err = w.Write([]byte("\r\n"))
+	return err
+}
+
+func parseTrailer(trailer []byte) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range bytes.Split(bytes.TrimSuffix(trailer, []byte("\r\n")), []byte("\r\n")) {
+		if i := bytes.IndexByte(line, ':'); i > 0 {
+			fields[string(bytes.TrimSpace(line[:i]))] = string(bytes.TrimSpace(line[i+1:]))
+		}
+	}
+	return fields
+}
@@ -0,0 +1,327 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muyuballs/go-proxy/core/common"
+	"github.com/valyala/fasthttp"
+)
+
+// startUpstream serves raw responses written by answer, the connection is
+// closed when answer returns false.
+func startUpstream(t *testing.T, answer func(c net.Conn, req *http.Request, body []byte) bool) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					body, _ := ioutil.ReadAll(req.Body)
+					if !answer(c, req, body) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialProxy connects to the http proxy handler served like HandleHttp does.
+func dialProxy(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	server := &fasthttp.Server{Handler: httpHandler(&common.Config{})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(&clientConn{ACStream: common.NewACS(c)})
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	return c, bufio.NewReader(c)
+}
+
+func roundTrip(t *testing.T, c net.Conn, br *bufio.Reader, method, raw string) (*http.Response, string) {
+	t.Helper()
+	if _, err := io.WriteString(c, raw); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(br, &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func get(addr, path string) string {
+	return fmt.Sprintf("GET http://%s%s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, path, addr)
+}
+
+// answerOK is the follow up request showing the client connection is
+// still in sync after the response under test.
+func answerOK(c net.Conn) bool {
+	io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	return true
+}
+
+func checkOK(t *testing.T, c net.Conn, br *bufio.Reader, addr string) {
+	t.Helper()
+	if _, body := roundTrip(t, c, br, "GET", get(addr, "/ok")); body != "ok" {
+		t.Errorf("follow up body = %q", body)
+	}
+}
+
+func TestChunkedTrailer(t *testing.T) {
+	big := strings.Repeat("0123456789", 20000)
+	addr := startUpstream(t, func(c net.Conn, req *http.Request, body []byte) bool {
+		switch req.URL.Path {
+		case "/small":
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n"+
+				"5;name=val\r\nhello\r\n6 ; a=\"b;c\"\r\n world\r\n0;last\r\nX-Sum: 42\r\nContent-Length: 9\r\n\r\n")
+		case "/big":
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n")
+			for i := 0; i < len(big); i += 7000 {
+				part := big[i:]
+				if len(part) > 7000 {
+					part = part[:7000]
+				}
+				fmt.Fprintf(c, "%x\r\n%s\r\n", len(part), part)
+			}
+			io.WriteString(c, "0\r\nX-Sum: big\r\n\r\n")
+		default:
+			return answerOK(c)
+		}
+		return true
+	})
+	c, br := dialProxy(t)
+	cases := []struct {
+		path, body, sum string
+	}{
+		{"/small", "hello world", "42"},
+		// a body larger than the buffers goes out in several chunks
+		{"/big", big, "big"},
+	}
+	for _, cs := range cases {
+		resp, body := roundTrip(t, c, br, "GET", get(addr, cs.path))
+		if body != cs.body {
+			t.Errorf("%s: body of %d bytes, want %d", cs.path, len(body), len(cs.body))
+		}
+		if got := resp.Trailer.Get("X-Sum"); got != cs.sum {
+			t.Errorf("%s: trailer X-Sum = %q, want %q", cs.path, got, cs.sum)
+		}
+		if got := resp.Trailer.Get("Content-Length"); got != "" {
+			t.Errorf("%s: framing field in trailer: %q", cs.path, got)
+		}
+	}
+	checkOK(t, c, br, addr)
+}
+
+func TestContentLength(t *testing.T) {
+	addr := startUpstream(t, func(c net.Conn, req *http.Request, body []byte) bool {
+		if req.URL.Path != "/cl" {
+			return answerOK(c)
+		}
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world")
+		return true
+	})
+	c, br := dialProxy(t)
+	resp, body := roundTrip(t, c, br, "GET", get(addr, "/cl"))
+	if body != "hello world" || resp.ContentLength != 11 {
+		t.Errorf("body = %q, length %d", body, resp.ContentLength)
+	}
+	checkOK(t, c, br, addr)
+}
+
+func TestCloseDelimited(t *testing.T) {
+	addr := startUpstream(t, func(c net.Conn, req *http.Request, body []byte) bool {
+		switch req.URL.Path {
+		case "/eof":
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nbody up to close")
+			return false
+		case "/http10":
+			io.WriteString(c, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nold school body")
+			return false
+		}
+		return answerOK(c)
+	})
+	c, br := dialProxy(t)
+	for _, path := range []string{"/eof", "/http10"} {
+		_, body := roundTrip(t, c, br, "GET", get(addr, path))
+		want := "body up to close"
+		if path == "/http10" {
+			want = "old school body"
+		}
+		if body != want {
+			t.Errorf("%s: body = %q, want %q", path, body, want)
+		}
+	}
+	// the proxy chunked the body, the client connection stays usable
+	checkOK(t, c, br, addr)
+}
+
+func TestNoBody(t *testing.T) {
+	addr := startUpstream(t, func(c net.Conn, req *http.Request, body []byte) bool {
+		switch req.URL.Path {
+		case "/head":
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 1234\r\nContent-Type: text/x\r\n\r\n")
+		case "/headnolen":
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Type: text/x\r\n\r\n")
+		case "/204":
+			io.WriteString(c, "HTTP/1.1 204 No Content\r\nX-A: b\r\n\r\n")
+		case "/304":
+			io.WriteString(c, "HTTP/1.1 304 Not Modified\r\nETag: \"x\"\r\n\r\n")
+		default:
+			return answerOK(c)
+		}
+		return true
+	})
+	c, br := dialProxy(t)
+	cases := []struct {
+		method, path string
+		status       int
+	}{
+		{"HEAD", "/head", 200},
+		{"HEAD", "/headnolen", 200},
+		{"GET", "/204", 204},
+		{"GET", "/304", 304},
+	}
+	for _, cs := range cases {
+		raw := strings.Replace(get(addr, cs.path), "GET", cs.method, 1)
+		resp, body := roundTrip(t, c, br, cs.method, raw)
+		if resp.StatusCode != cs.status || body != "" {
+			t.Errorf("%s %s: status %d body %q", cs.method, cs.path, resp.StatusCode, body)
+		}
+		if resp.TransferEncoding != nil {
+			t.Errorf("%s %s: transfer encoding %v", cs.method, cs.path, resp.TransferEncoding)
+		}
+		checkOK(t, c, br, addr)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	addr := startUpstream(t, func(c net.Conn, req *http.Request, body []byte) bool {
+		if req.URL.Path != "/expect" {
+			return answerOK(c)
+		}
+		// interim responses of the upstream are not passed on
+		reply := fmt.Sprintf("expect=%s body=%s", req.Header.Get("Expect"), body)
+		fmt.Fprintf(c, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </a>\r\n\r\n"+
+			"HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(reply), reply)
+		return true
+	})
+	c, br := dialProxy(t)
+	fmt.Fprintf(c, "POST http://%s/expect HTTP/1.1\r\nHost: %s\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n", addr, addr)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "POST"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("status %d, want 100 before the body", resp.StatusCode)
+	}
+	resp, body := roundTrip(t, c, br, "POST", "data")
+	if resp.StatusCode != http.StatusOK || body != "expect= body=data" {
+		t.Errorf("status %d body %q", resp.StatusCode, body)
+	}
+	checkOK(t, c, br, addr)
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	addr := startUpstream(t, func(c net.Conn, req *http.Request, body []byte) bool {
+		switch req.URL.Path {
+		case "/ka":
+			io.WriteString(c, "HTTP/1.0 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nka")
+			return true
+		case "/eof":
+			io.WriteString(c, "HTTP/1.0 200 OK\r\n\r\nuntil close")
+			return false
+		case "/chunked":
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nuntil\r\n6\r\n close\r\n0\r\nX-Sum: 1\r\n\r\n")
+			return true
+		}
+		return answerOK(c)
+	})
+	c, br := dialProxy(t)
+	get10 := func(path string) string {
+		return fmt.Sprintf("GET http://%s%s HTTP/1.0\r\nHost: %s\r\nConnection: keep-alive\r\n\r\n", addr, path, addr)
+	}
+	for i := 0; i < 2; i++ {
+		resp, body := roundTrip(t, c, br, "GET", get10("/ka"))
+		if body != "ka" || resp.Close {
+			t.Fatalf("request %d: body %q close %v", i, body, resp.Close)
+		}
+	}
+	// an http/1.0 client can't get a chunked body, the end is the close
+	for _, path := range []string{"/eof", "/chunked"} {
+		c, br := dialProxy(t)
+		resp, body := roundTrip(t, c, br, "GET", get10(path))
+		if body != "until close" || resp.TransferEncoding != nil || !resp.Close {
+			t.Errorf("%s: body %q transfer encoding %v close %v", path, body, resp.TransferEncoding, resp.Close)
+		}
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Errorf("%s: connection open after a close delimited body: %v", path, err)
+		}
+	}
+}
+
+func TestChunkedCutShort(t *testing.T) {
+	addr := startUpstream(t, func(c net.Conn, req *http.Request, body []byte) bool {
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n10\r\nshort")
+		return false
+	})
+	c, br := dialProxy(t)
+	io.WriteString(c, get(addr, "/"))
+	resp, err := http.ReadResponse(br, &http.Request{Method: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the body ends without a last chunk and the connection is closed
+	if body, err := ioutil.ReadAll(resp.Body); err != io.ErrUnexpectedEOF {
+		t.Errorf("body %q, read error %v", body, err)
+	}
+}
+
+func TestParseTrailer(t *testing.T) {
+	got := parseTrailer([]byte("X-Sum: 42\r\nX-Empty:\r\n"))
+	if len(got) != 2 || got["X-Sum"] != "42" || got["X-Empty"] != "" {
+		t.Errorf("parseTrailer = %v", got)
+	}
+}
@@ -58,10 +58,13 @@ func BuildFullUrl(protocol, host, path string) string {
 func InitHandler(conf *common.Config) {
 	_server.Handler = httpHandler(conf)
 	initHttpsHandler(conf)
+	if conf.HttpPoolIdle > 0 {
+		go upstreamPool.reap(conf)
+	}
 }
 
 func HandleHttp(acs *common.ACStream) (err error) {
-	return _server.ServeConn(acs)
+	return _server.ServeConn(&clientConn{ACStream: acs})
 }
 
 func hostToTcpAddr(host string, defPort int) (addr string, err error) {
@@ -82,9 +85,13 @@ func httpHandler(conf *common.Config) func(*fasthttp.RequestCtx) {
 		certPath = conf.HelloPageUrl + "do-not-trust.crt"
 	}
 	return func(ctx *fasthttp.RequestCtx) {
+		startRequest(ctx)
 		defer func() {
 			log.Println("ctx done")
 		}()
+		if !checkProxyAuth(ctx) {
+			return
+		}
 		if "CONNECT" == string(ctx.Method()) {
 			target, err := hostToTcpAddr(string(ctx.Host()), HttpsPort)
 			if err != nil {
@@ -93,6 +100,14 @@ func httpHandler(conf *common.Config) func(*fasthttp.RequestCtx) {
 				return
 			}
 			log.Println(target)
+			// dial before the 200 even when decrypting, so an unreachable
+			// target is answered with 502/504 instead of a bare close
+			rconn, err := common.DialRemote(conf, connMetadata(ctx), target)
+			if err != nil {
+				log.Println(err)
+				ctx.Error(err.Error(), dialErrorStatus(err))
+				return
+			}
 			ctx.SetStatusCode(fasthttp.StatusOK)
 			ctx.Hijack(func(lconn net.Conn) {
 				lacs := common.NewACS(lconn)
@@ -102,11 +117,14 @@ func httpHandler(conf *common.Config) func(*fasthttp.RequestCtx) {
 				v, err := lacs.Pick(6)
 				if err != nil {
 					log.Println(err)
+					rconn.Close()
 					return
 				}
 				if conf.DecryptHttps {
 					if v[0] == 0x16 && v[1] == 0x03 && v[2] <= 3 && v[5] == 0x01 {
 						log.Println("ssl", SslVersionMap[v[2]], " handshake")
+						// decrypted requests dial their own connections
+						rconn.Close()
 						err := handleHttps(common.NewACS(tls.Server(lacs.Open(), &tls.Config{
 							GetCertificate: func(info *tls.ClientHelloInfo) (certificate *tls.Certificate, e error) {
 								return genCertificate(info.ServerName)
@@ -121,11 +139,6 @@ func httpHandler(conf *common.Config) func(*fasthttp.RequestCtx) {
 				sessionInfo := buildSessionInfo(conf, ctx)
 				sessionInfo.RequestInfo.FullUrl = BuildFullUrl("https", string(ctx.Host()), string(ctx.RequestURI()))
 				sessionInfo.RequestInfo.Protocol = "TUNNEL"
-				rconn, err := common.DialRemote(conf, nil, target)
-				if err != nil {
-					log.Println(err)
-					return
-				}
 				racs := common.NewACS(rconn)
 				defer func() {
 					_ = racs.Close()
@@ -169,14 +182,12 @@ func httpHandler(conf *common.Config) func(*fasthttp.RequestCtx) {
 				return
 			}
 			trimRequestHeader(ctx)
-			rconn, err := common.DialRemote(conf, nil, target)
-			if err != nil {
-				log.Println(err)
-				ctx.Error(err.Error(), fasthttp.StatusServiceUnavailable)
-				sessionInfo.SessionDone()
-				return
-			}
-			copyHttpPayload(ctx, sessionInfo, rconn, conf)
+			copyHttpPayload(ctx, sessionInfo, conf, &upstream{
+				key: poolKey(conf, ctx, target),
+				dial: func() (*common.ACStream, error) {
+					return common.DialRemote(conf, connMetadata(ctx), target)
+				},
+			})
 		}
 	}
 }
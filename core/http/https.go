@@ -28,11 +28,12 @@ func HandleHttps(acs *common.ACStream) (err error) {
 }
 
 func handleHttps(acs *common.ACStream) (err error) {
-	return _httpsServer.ServeConn(acs)
+	return _httpsServer.ServeConn(&clientConn{ACStream: acs})
 }
 
 func httpsHandler(conf *common.Config) func(*fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
+		startRequest(ctx)
 		defer func() {
 			log.Println("ctx done")
 		}()
@@ -47,17 +48,19 @@ func httpsHandler(conf *common.Config) func(*fasthttp.RequestCtx) {
 				return
 			}
 			log.Println(target)
+			rconn, err := common.DialRemote(conf, connMetadata(ctx), target)
+			if err != nil {
+				log.Println(err)
+				ctx.Error(err.Error(), dialErrorStatus(err))
+				sessionInfo.SessionDone()
+				return
+			}
 			ctx.SetStatusCode(fasthttp.StatusOK)
 			ctx.Hijack(func(lconn net.Conn) {
 				lacs := common.NewACS(lconn)
 				defer func() {
 					_ = lacs.Close()
 				}()
-				rconn, err := common.DialRemote(conf, nil, target)
-				if err != nil {
-					log.Println(err)
-					return
-				}
 				racs := common.NewACS(rconn)
 				defer func() {
 					_ = racs.Close()
@@ -78,18 +81,23 @@ func httpsHandler(conf *common.Config) func(*fasthttp.RequestCtx) {
 				return
 			}
 			trimRequestHeader(ctx)
-			rconn, err := common.DialRemote(conf, nil, target)
-			if err != nil {
-				log.Println(err)
-				ctx.Error(err.Error(), fasthttp.StatusServiceUnavailable)
-				sessionInfo.SessionDone()
-				return
+			up := &upstream{
+				dial: func() (*common.ACStream, error) {
+					rconn, err := common.DialRemote(conf, connMetadata(ctx), target)
+					if err != nil {
+						return nil, err
+					}
+					xrconn := common.NewACS(tls.Client(rconn.Origin().(net.Conn), &tls.Config{
+						InsecureSkipVerify: true,
+					}))
+					rconn.Destroy()
+					return xrconn, nil
+				},
+			}
+			if key := poolKey(conf, ctx, target); key != "" {
+				up.key = "tls " + key
 			}
-			xrconn := common.NewACS(tls.Client(rconn.Origin().(net.Conn), &tls.Config{
-				InsecureSkipVerify: true,
-			}))
-			rconn.Destroy()
-			copyHttpPayload(ctx, sessionInfo, xrconn, conf)
+			copyHttpPayload(ctx, sessionInfo, conf, up)
 		}
 	}
 }
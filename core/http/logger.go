@@ -6,6 +6,7 @@ import (
 	"hash/crc32"
 	"log"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -17,27 +18,33 @@ type FileInfo struct {
 }
 
 type RequestInfo struct {
-	Version     string
-	Protocol    string
-	Method      string
-	Host        string
-	FullUrl     string
-	Url         string
-	Headers     map[string]string
-	Query       map[string]string
-	WebForm     map[string]string
-	Files       []*FileInfo
-	ContentType string
-	Body        []byte
+	Version       string
+	Protocol      string
+	Method        string
+	Host          string
+	FullUrl       string
+	Url           string
+	Headers       map[string]string
+	Query         map[string]string
+	WebForm       map[string]string
+	Files         []*FileInfo
+	ContentType   string
+	Body          []byte
+	BodyFile      string
+	BodyTruncated bool
 }
 
 type ResponseInfo struct {
-	Status      int
-	Version     string
-	Message     string
-	BodySize    int
-	ContextType string
-	Headers     map[string]string
+	Status        int
+	Version       string
+	Message       string
+	BodySize      int
+	ContextType   string
+	Headers       map[string]string
+	Trailers      map[string]string
+	Body          []byte
+	BodyFile      string
+	BodyTruncated bool
 }
 
 type SessionInfo struct {
@@ -46,10 +53,13 @@ type SessionInfo struct {
 	EndTime      time.Time
 	RemoteAddr   string
 	RemotePort   int
+	User         string
 	RequestInfo  *RequestInfo
 	ResponseInfo *ResponseInfo
 	Done         bool
 	endChan      chan int
+	// lock guards what is set while the log ticker marshals the session
+	lock *sync.Mutex
 }
 
 func NewSessionInfo(conf *common.Config) *SessionInfo {
@@ -57,6 +67,7 @@ func NewSessionInfo(conf *common.Config) *SessionInfo {
 		Sid:       strconv.FormatInt(time.Now().UnixNano(), 16),
 		BeginTime: time.Now(),
 		endChan:   make(chan int),
+		lock:      &sync.Mutex{},
 	}
 	if conf.LogChan != nil {
 		go func() {
@@ -70,7 +81,9 @@ func NewSessionInfo(conf *common.Config) *SessionInfo {
 					log.Println("session done")
 					return
 				case <-time.Tick(time.Second):
+					sif.lock.Lock()
 					nHash := crc32WithGob(sif)
+					sif.lock.Unlock()
 					if nHash != oldHash {
 						oldHash = nHash
 						sendLogToChan(conf, sif)
@@ -83,11 +96,21 @@ func NewSessionInfo(conf *common.Config) *SessionInfo {
 }
 
 func (s *SessionInfo) SessionDone() {
-	s.EndTime = time.Now()
-	s.Done = true
+	s.update(func() {
+		s.EndTime = time.Now()
+		s.Done = true
+	})
 	close(s.endChan)
 }
 
+// update changes the session under its lock, the log ticker may be
+// marshalling it meanwhile.
+func (s *SessionInfo) update(f func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f()
+}
+
 func crc32WithGob(v interface{}) uint32 {
 	data, _ := json.Marshal(v)
 	return crc32.ChecksumIEEE(data)
@@ -0,0 +1,166 @@
+package http
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/muyuballs/go-proxy/core/common"
+	"github.com/valyala/fasthttp"
+)
+
+// idleConn is a kept-alive upstream connection waiting for the next request
+// to the same target and route.
+type idleConn struct {
+	acs  *common.ACStream
+	idle time.Time
+}
+
+// upstream dials the target of proxied requests, through the pool when key
+// is set.
+type upstream struct {
+	key  string
+	dial func() (*common.ACStream, error)
+}
+
+// get takes an idle connection only for a request that can be sent again,
+// the upstream may have closed it meanwhile.
+func (up *upstream) get(conf *common.Config, req *fasthttp.Request) (rconn *common.ACStream, reused bool, err error) {
+	if !retryable(req) {
+		rconn, err = up.dial()
+		return rconn, false, err
+	}
+	if rconn = upstreamPool.get(conf, up.key); rconn != nil {
+		return rconn, true, nil
+	}
+	rconn, err = up.dial()
+	return rconn, false, err
+}
+
+type connPool struct {
+	idle map[string][]*idleConn
+	lock *sync.Mutex
+}
+
+var upstreamPool = &connPool{idle: make(map[string][]*idleConn), lock: &sync.Mutex{}}
+
+func poolTTL(conf *common.Config) time.Duration {
+	return time.Duration(conf.HttpPoolTTL) * time.Second
+}
+
+// poolKey includes the routing decision, so clients routed differently
+// never share a connection. A connection that got a PROXY header names the
+// client it was dialed for, so none are pooled when the header is sent.
+func poolKey(conf *common.Config, ctx *fasthttp.RequestCtx, target string) string {
+	if conf.HttpPoolIdle <= 0 || conf.SessionCacheDir != "" || conf.ProxyProtoOut > 0 {
+		return ""
+	}
+	return common.Route(conf, connMetadata(ctx), target).String() + " " + target
+}
+
+func (p *connPool) get(conf *common.Config, key string) *common.ACStream {
+	if key == "" {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	list := p.idle[key]
+	for len(list) > 0 {
+		ic := list[len(list)-1]
+		list = list[:len(list)-1]
+		if time.Since(ic.idle) < poolTTL(conf) {
+			p.idle[key] = list
+			return ic.acs
+		}
+		ic.acs.Close()
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+func (p *connPool) put(conf *common.Config, key string, acs *common.ACStream) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if key == "" || len(p.idle[key]) >= conf.HttpPoolIdle {
+		acs.Close()
+		return
+	}
+	p.idle[key] = append(p.idle[key], &idleConn{acs: acs, idle: time.Now()})
+}
+
+// reap closes the connections idle for longer than --http-pool-ttl.
+func (p *connPool) reap(conf *common.Config) {
+	ticker := time.NewTicker(poolTTL(conf)/2 + time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conf.Context.Done():
+			return
+		case <-ticker.C:
+		}
+		p.lock.Lock()
+		n := 0
+		for key, list := range p.idle {
+			alive := list[:0]
+			for _, ic := range list {
+				if time.Since(ic.idle) < poolTTL(conf) {
+					alive = append(alive, ic)
+				} else {
+					ic.acs.Close()
+				}
+			}
+			if len(alive) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = alive
+			}
+			n += len(alive)
+		}
+		p.lock.Unlock()
+		if n > 0 {
+			log.Println("http pool idle connections", n)
+		}
+	}
+}
+
+// bodyReader streams a response body and gives the connection back once the
+// body was read to the end, either remain bytes or up to the io.EOF of r when
+// r delimits the body itself.
+type bodyReader struct {
+	r       io.Reader
+	remain  int64
+	eof     bool
+	count   *int64
+	capture *bodyCapture
+	release func(reuse bool)
+	once    *sync.Once
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.remain >= 0 && int64(len(p)) > b.remain {
+		p = p[:b.remain]
+	}
+	if len(p) == 0 {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	*b.count += int64(n)
+	if b.capture != nil && n > 0 {
+		b.capture.Write(p[:n])
+	}
+	if b.remain >= 0 {
+		b.remain -= int64(n)
+	}
+	if err == io.EOF && b.eof {
+		b.remain = 0
+	}
+	return n, err
+}
+
+func (b *bodyReader) Close() error {
+	b.once.Do(func() {
+		b.release(b.remain == 0)
+	})
+	return nil
+}
@@ -9,12 +9,21 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"strings"
 	"time"
 
 	"context"
 	"github.com/urfave/cli"
 )
 
+var secretFields = map[string]bool{
+	"Token":          true,
+	"RemoteUser":     true,
+	"RemoteProxy":    true,
+	"UpstreamProxy":  true,
+	"NamedUpstreams": true,
+}
+
 func startService(conf *common.Config) error {
 	go func() {
 		for {
@@ -23,6 +32,10 @@ func startService(conf *common.Config) error {
 				return
 			case <-time.Tick(15 * time.Second):
 				common.PrintAcs()
+				common.PrintSessions()
+				common.PrintRemotes()
+				common.PrintReverse()
+				client.PrintForwards()
 			}
 		}
 	}()
@@ -31,6 +44,10 @@ func startService(conf *common.Config) error {
 	tpe := reflect.TypeOf(*conf)
 	for i := 0; i < val.NumField(); i++ {
 		if val.Field(i).CanInterface() {
+			if secretFields[tpe.Field(i).Name] && val.Field(i).String() != "" {
+				log.Printf("%-20s : %v\n", tpe.Field(i).Name, "******")
+				continue
+			}
 			log.Printf("%-20s : %v\n", tpe.Field(i).Name, val.Field(i).Interface())
 		}
 	}
@@ -48,18 +65,23 @@ func Main(ctx context.Context, logChan chan interface{}, args ...string) {
 		cli.StringFlag{
 			Name:  "listen",
 			Value: "0.0.0.0:8999",
-			Usage: "proxy port",
+			Usage: "proxy port, in server mode scheme://host:port picks the tunnel transport",
 		},
 		cli.StringFlag{
 			Name:  "certificate",
 			Value: "",
-			Usage: "server ssl certificate,(default auto gen)",
+			Usage: "server ssl certificate,(default auto gen, kept in server-key-dir)",
 		},
 		cli.StringFlag{
 			Name:  "cert-key",
 			Value: "",
 			Usage: "server ssl certificate key,(default auto gen)",
 		},
+		cli.StringFlag{
+			Name:  "server-key-dir",
+			Value: "",
+			Usage: "server mode, private dir of the generated tunnel key, default is go-proxy in the user config dir",
+		},
 		cli.StringFlag{
 			Name:  "log",
 			Value: "-",
@@ -87,7 +109,7 @@ func Main(ctx context.Context, logChan chan interface{}, args ...string) {
 		},
 		cli.StringFlag{
 			Name:  "remote",
-			Usage: "run in client mode with remote server",
+			Usage: "run in client mode with remote server, scheme://host:port, a comma separated list fails over",
 			Value: "", //ss.yuelwish.top:60000
 		},
 		cli.BoolFlag{
@@ -122,6 +144,181 @@ func Main(ctx context.Context, logChan chan interface{}, args ...string) {
 			Usage: "server name",
 			Value: "Sot",
 		},
+		cli.StringFlag{
+			Name:  "token",
+			Usage: "tunnel pre-shared token",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "users-file",
+			Usage: "users file, one user:password or user:bcrypt-hash per line, checks tunnel clients in server mode and socks5 clients in client mode",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "remote-user",
+			Usage: "client mode tunnel credential, user:password",
+			Value: "",
+		},
+		cli.IntFlag{
+			Name:  "max-sessions",
+			Usage: "client mode max tunnel sessions",
+			Value: 4,
+		},
+		cli.IntFlag{
+			Name:  "max-streams",
+			Usage: "max streams per tunnel session",
+			Value: 256,
+		},
+		cli.StringSliceFlag{
+			Name:  "named-remote",
+			Usage: "client mode extra tunnel server used by PROXY:name rules, name=host:port",
+		},
+		cli.BoolFlag{
+			Name:  "resolve-rules",
+			Usage: "resolve domain targets to match ip rules",
+		},
+		cli.StringFlag{
+			Name:  "geoip-db",
+			Usage: "GeoLite2-Country mmdb file used by GEOIP rules",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "remote-strategy",
+			Usage: "how to pick one of several remotes: primary-backup, round-robin or lowest-latency",
+			Value: common.StrategyPrimaryBackup,
+		},
+		cli.IntFlag{
+			Name:  "health-interval",
+			Usage: "seconds between remote health probes, 0 disables probing",
+			Value: 10,
+		},
+		cli.StringFlag{
+			Name:  "remote-ca",
+			Usage: "client mode, verify the tunnel server with this ca file",
+			Value: "",
+		},
+		cli.StringSliceFlag{
+			Name:  "remote-pin",
+			Usage: "client mode, accept a tunnel server key by its pin, sha256:base64 as logged by the server",
+		},
+		cli.StringFlag{
+			Name:  "known-hosts",
+			Usage: "client mode, trust on first use file for tunnel server keys, default is known_hosts in cert-cache-dir",
+			Value: "",
+		},
+		cli.BoolFlag{
+			Name:  "remote-insecure",
+			Usage: "client mode, do not verify the tunnel server certificate",
+		},
+		cli.StringFlag{
+			Name:  "client-ca",
+			Usage: "server mode, require tunnel client certificates signed by this ca file, the decoy page of the wss transport is served without one",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "client-crl",
+			Usage: "server mode, crl file of revoked client certificates",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "client-deny",
+			Usage: "server mode, denied client certificates, one common name or hex serial per line",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "client-cert",
+			Usage: "client mode, certificate presented to the tunnel server",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "client-key",
+			Usage: "client mode, key of client-cert",
+			Value: "",
+		},
+		cli.IntFlag{
+			Name:  "max-user-streams",
+			Usage: "server mode, max open streams per user, clients without a user are counted per source ip, 0 is unlimited",
+			Value: 0,
+		},
+		cli.StringFlag{
+			Name:  "transport",
+			Usage: "tunnel transport of addresses without scheme: " + strings.Join(common.ListTransports(), ", "),
+			Value: common.TransportTLS,
+		},
+		cli.StringFlag{
+			Name:  "ws-path",
+			Usage: "websocket transport upgrade path",
+			Value: "/ws",
+		},
+		cli.StringFlag{
+			Name:  "remote-proxy",
+			Usage: "client mode, reach the tunnel server through this proxy, http://[user:pass@]host:port or socks5[h]://, defaults to --upstream-proxy",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "upstream-proxy",
+			Usage: "client mode, parent proxy of UPSTREAM rules and of the tunnel, http://[user:pass@]host:port or socks5[h]://[user:pass@]host:port",
+			Value: "",
+		},
+		cli.StringSliceFlag{
+			Name:  "named-upstream",
+			Usage: "client mode, parent proxy used by UPSTREAM:name rules, name=url",
+		},
+		cli.StringFlag{
+			Name:  "decoy-dir",
+			Usage: "server mode, files served to non websocket requests of the ws and wss transports",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "client mode, tunnel compression, none or flate",
+			Value: "none",
+		},
+		cli.StringSliceFlag{
+			Name:  "reverse",
+			Usage: "client mode, expose a local service on the remote server, listen=target e.g. 8080=127.0.0.1:3000",
+		},
+		cli.StringSliceFlag{
+			Name:  "forward",
+			Usage: "client mode, forward a local port to a fixed target, local=target e.g. 5433=db.internal:5432",
+		},
+		cli.StringFlag{
+			Name:  "transparent",
+			Usage: "client mode, linux only, listen for connections redirected by iptables REDIRECT, e.g. :1081",
+			Value: "",
+		},
+		cli.StringSliceFlag{
+			Name:  "proxy-protocol-from",
+			Usage: "read PROXY protocol v1/v2 headers on the listener from these balancer cidrs",
+		},
+		cli.StringFlag{
+			Name:  "proxy-protocol-out",
+			Usage: "client mode, send a PROXY protocol header, v1 or v2, on direct connections to --proxy-protocol-to",
+			Value: "",
+		},
+		cli.StringSliceFlag{
+			Name:  "proxy-protocol-to",
+			Usage: "client mode, target cidrs that expect the PROXY protocol header, default is every direct connection",
+		},
+		cli.IntFlag{
+			Name:  "http-pool-idle",
+			Usage: "client mode, idle keep-alive upstream connections kept per target of the http proxy, 0 disables the pool",
+			Value: 8,
+		},
+		cli.IntFlag{
+			Name:  "http-pool-ttl",
+			Usage: "client mode, seconds an idle upstream connection of the http proxy is kept",
+			Value: 60,
+		},
+		cli.IntFlag{
+			Name:  "capture-body",
+			Usage: "client mode, bytes of http request and response bodies kept in the session log, larger bodies are spilled to --session-cache-dir, 0 disables",
+			Value: 0,
+		},
+		cli.StringSliceFlag{
+			Name:  "reverse-ports",
+			Usage: "server mode, ports a user may listen on for reverse tunnels, user=8000-8100,9000, * for every user",
+		},
 	}
 	myApp.Action = func(c *cli.Context) (err error) {
 		conf := &common.Config{
@@ -132,6 +329,7 @@ func Main(ctx context.Context, logChan chan interface{}, args ...string) {
 			Listen:           c.String("listen"),
 			Certificate:      c.String("certificate"),
 			CertKey:          c.String("cert-key"),
+			ServerKeyDir:     c.String("server-key-dir"),
 			LolFile:          c.String("local-only-list"),
 			ServerMode:       c.Bool("server"),
 			Remote:           c.String("remote"),
@@ -146,6 +344,83 @@ func Main(ctx context.Context, logChan chan interface{}, args ...string) {
 			CertCache:        c.String("cert-cache-dir"),
 			HelloPageUrl:     c.String("hello-page-url"),
 			ServerName:       c.String("server-name"),
+			Token:            c.String("token"),
+			UsersFile:        c.String("users-file"),
+			RemoteUser:       c.String("remote-user"),
+			MaxSessions:      c.Int("max-sessions"),
+			MaxStreams:       c.Int("max-streams"),
+			ResolveRules:     c.Bool("resolve-rules"),
+			GeoIPFile:        c.String("geoip-db"),
+			RemoteStrategy:   c.String("remote-strategy"),
+			HealthInterval:   c.Int("health-interval"),
+			RemoteCA:         c.String("remote-ca"),
+			RemotePins:       c.StringSlice("remote-pin"),
+			KnownHosts:       c.String("known-hosts"),
+			RemoteInsecure:   c.Bool("remote-insecure"),
+			ClientCA:         c.String("client-ca"),
+			ClientCRL:        c.String("client-crl"),
+			ClientDeny:       c.String("client-deny"),
+			ClientCert:       c.String("client-cert"),
+			ClientKey:        c.String("client-key"),
+			MaxUserStreams:   c.Int("max-user-streams"),
+			Transport:        c.String("transport"),
+			WSPath:           c.String("ws-path"),
+			RemoteProxy:      c.String("remote-proxy"),
+			UpstreamProxy:    c.String("upstream-proxy"),
+			Transparent:      c.String("transparent"),
+			HttpPoolIdle:     c.Int("http-pool-idle"),
+			HttpPoolTTL:      c.Int("http-pool-ttl"),
+			CaptureBody:      c.Int("capture-body"),
+			DecoyDir:         c.String("decoy-dir"),
+		}
+		conf.NamedRemotes, err = common.ParseNamedRemotes(c.StringSlice("named-remote"))
+		if err != nil {
+			return err
+		}
+		conf.Compress, err = common.ParseCompress(c.String("compress"))
+		if err != nil {
+			return err
+		}
+		conf.Reverse, err = common.ParseReverse(c.StringSlice("reverse"))
+		if err != nil {
+			return err
+		}
+		conf.ReversePorts, err = common.ParseReversePorts(c.StringSlice("reverse-ports"))
+		if err != nil {
+			return err
+		}
+		conf.Forwards, err = client.ParseForwards(c.StringSlice("forward"))
+		if err != nil {
+			return err
+		}
+		conf.NamedUpstreams, err = common.ParseNamedUpstreams(c.StringSlice("named-upstream"))
+		if err != nil {
+			return err
+		}
+		conf.ProxyProtoFrom, err = common.ParseCIDRList(c.StringSlice("proxy-protocol-from"))
+		if err != nil {
+			return err
+		}
+		conf.ProxyProtoOut, err = common.ParseProxyProtocolVersion(c.String("proxy-protocol-out"))
+		if err != nil {
+			return err
+		}
+		conf.ProxyProtoTo, err = common.ParseCIDRList(c.StringSlice("proxy-protocol-to"))
+		if err != nil {
+			return err
+		}
+		for _, raw := range []string{conf.RemoteProxy, conf.UpstreamProxy} {
+			if _, err = common.ParseUpstream(raw); raw != "" && err != nil {
+				return err
+			}
+		}
+		if !common.HasTransport(conf.Transport) {
+			return fmt.Errorf("unknown transport:%s", conf.Transport)
+		}
+		switch conf.RemoteStrategy {
+		case common.StrategyPrimaryBackup, common.StrategyRoundRobin, common.StrategyLowestLatency:
+		default:
+			return fmt.Errorf("unknown remote strategy:%s", conf.RemoteStrategy)
 		}
 		if conf.DecryptHttps {
 			if err := http.InitCertCache(conf.CertCache); err != nil {
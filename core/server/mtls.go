@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muyuballs/go-proxy/core/common"
+)
+
+// revocation holds the serials of a local CRL and the names or serials of a
+// deny-list file, both are reloaded when the file changes.
+type revocation struct {
+	crlFile  string
+	denyFile string
+	crlMod   time.Time
+	denyMod  time.Time
+	serials  map[string]bool
+	denied   map[string]bool
+	lock     *sync.Mutex
+}
+
+func newRevocation(conf *common.Config) *revocation {
+	return &revocation{
+		crlFile:  conf.ClientCRL,
+		denyFile: conf.ClientDeny,
+		serials:  make(map[string]bool),
+		denied:   make(map[string]bool),
+		lock:     &sync.Mutex{},
+	}
+}
+
+func changed(file string, mod *time.Time) bool {
+	if file == "" {
+		return false
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if fi.ModTime().Equal(*mod) {
+		return false
+	}
+	*mod = fi.ModTime()
+	return true
+}
+
+func (r *revocation) reload() {
+	if changed(r.crlFile, &r.crlMod) {
+		serials, err := parseCRLFile(r.crlFile)
+		if err != nil {
+			log.Println("client crl", err)
+		} else {
+			log.Println("load client crl", r.crlFile, len(serials))
+			r.serials = serials
+		}
+	}
+	if changed(r.denyFile, &r.denyMod) {
+		denied, err := parseDenyFile(r.denyFile)
+		if err != nil {
+			log.Println("client deny list", err)
+		} else {
+			log.Println("load client deny list", r.denyFile, len(denied))
+			r.denied = denied
+		}
+	}
+}
+
+func parseCRLFile(file string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+	serials := make(map[string]bool)
+	for _, rc := range crl.RevokedCertificateEntries {
+		serials[fmt.Sprintf("%x", rc.SerialNumber)] = true
+	}
+	return serials, nil
+}
+
+// parseDenyFile reads one certificate common name or hex serial per line.
+func parseDenyFile(file string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	denied := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denied[line] = true
+	}
+	return denied, scanner.Err()
+}
+
+func (r *revocation) check(cert *x509.Certificate) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.reload()
+	serial := fmt.Sprintf("%x", cert.SerialNumber)
+	if r.serials[serial] {
+		return fmt.Errorf("client certificate %s revoked", serial)
+	}
+	if r.denied[serial] || r.denied[cert.Subject.CommonName] {
+		return fmt.Errorf("client certificate %s (%s) denied", serial, cert.Subject.CommonName)
+	}
+	return nil
+}
+
+// setupClientAuth requires client certificates signed by --client-ca.
+func setupClientAuth(conf *common.Config, tlsConfig *tls.Config) error {
+	if conf.ClientCA == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(conf.ClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificate found in %s", conf.ClientCA)
+	}
+	rev := newRevocation(conf)
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			// only the wss listener lets a client without certificate through,
+			// it gets the decoy page
+			return nil
+		}
+		if len(chains) == 0 || len(chains[0]) == 0 {
+			return errors.New("no verified client certificate")
+		}
+		return rev.check(chains[0][0])
+	}
+	return nil
+}
+
+// peerIdentity returns the subject common name of the client certificate,
+// conn is a tls connection or a websocket upgraded over tls.
+func peerIdentity(conf *common.Config, conn net.Conn) (string, error) {
+	var state tls.ConnectionState
+	switch c := conn.(type) {
+	case *tls.Conn:
+		if conf.ReadTimeout > 0 {
+			c.SetDeadline(time.Now().Add(time.Duration(conf.ReadTimeout) * time.Second))
+		}
+		if err := c.Handshake(); err != nil {
+			return "", err
+		}
+		c.SetDeadline(time.Time{})
+		state = c.ConnectionState()
+	case interface{ ConnectionState() tls.ConnectionState }:
+		state = c.ConnectionState()
+	}
+	if len(state.PeerCertificates) == 0 {
+		return "", nil
+	}
+	return state.PeerCertificates[0].Subject.CommonName, nil
+}
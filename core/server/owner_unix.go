@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkOwner wants path owned by this process with none of the mask bits
+// set.
+func checkOwner(path string, fi os.FileInfo, mask os.FileMode) error {
+	if fi.Mode().Perm()&mask != 0 {
+		return fmt.Errorf("%s is open to other users, mode %o", path, fi.Mode().Perm())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is owned by another user", path)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package server
+
+import "os"
+
+// checkOwner can't tell owner or access from the file mode on windows, the
+// user config dir is private there already.
+func checkOwner(path string, fi os.FileInfo, mask os.FileMode) error {
+	return nil
+}
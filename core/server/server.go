@@ -1,33 +1,63 @@
 package server
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/binary"
+	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"github.com/muyuballs/go-proxy/core/common"
+	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	userSessions = make(map[string][]*common.MuxSession)
+	usLock       = &sync.Mutex{}
 )
 
 func StartServer(conf *common.Config) (err error) {
-	var tlsConfig *tls.Config
+	var xcert tls.Certificate
 	if conf.Certificate != "" && conf.CertKey != "" {
-		xcert, err := tls.LoadX509KeyPair(conf.Certificate, conf.CertKey)
-		if err != nil {
-			return err
-		}
-		tlsConfig = &tls.Config{Certificates: []tls.Certificate{xcert}}
+		xcert, err = tls.LoadX509KeyPair(conf.Certificate, conf.CertKey)
 	} else {
-		tlsConfig, err = generateTLSConfig()
-		if err != nil {
-			return err
-		}
+		xcert, err = loadOrGenerateCert(conf)
+	}
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(xcert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	log.Println("server certificate pin", common.SPKIPin(leaf))
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{xcert}}
+	err = setupClientAuth(conf, tlsConfig)
+	if err != nil {
+		return err
+	}
+	err = common.LoadUsers(conf)
+	if err != nil {
+		return err
+	}
+	if conf.Token == "" && conf.UsersFile == "" && conf.ClientCA == "" {
+		log.Println("WARNING: tunnel authentication disabled, set --token, --users-file or --client-ca")
+	}
+	conf.ServerTLSConfig = tlsConfig
+	tr, err := common.NewTransport(conf, conf.Listen)
+	if err != nil {
+		return err
 	}
-	l, err := net.Listen("tcp", conf.Listen)
+	l, err := tr.Listen()
 	if err != nil {
 		return err
 	}
@@ -37,35 +67,125 @@ func StartServer(conf *common.Config) (err error) {
 			log.Println(err)
 			return err
 		}
-		if tcpConn, ok := session.(*net.TCPConn); ok {
-			tcpConn.SetNoDelay(true)
-		}
-		go handSession(tls.Server(session, tlsConfig))
+		go handSession(conf, session)
 	}
-	return nil
 }
 
-func handSession(ses net.Conn) {
+func handSession(conf *common.Config, ses net.Conn) {
 	log.Println("new session", ses.RemoteAddr())
+	identity, err := peerIdentity(conf, ses)
+	if err != nil {
+		log.Println("tls handshake", ses.RemoteAddr(), err)
+		ses.Close()
+		return
+	}
 	acs := common.NewACS(ses)
 	defer acs.Close()
-	var tl uint32
-	err := binary.Read(acs, binary.BigEndian, &tl)
+	user, compress, err := common.ServerHandshake(acs, conf)
 	if err != nil {
-		log.Println(err)
+		log.Println("handshake", ses.RemoteAddr(), err)
 		return
 	}
-	buf := make([]byte, tl)
-	err = common.ReadFull(acs, buf)
+	if user == "" {
+		user = identity
+	}
+	if user != "" {
+		log.Println("session user", user)
+	}
+	if compress != common.CompressNone {
+		log.Println("session compression", common.CompressName(compress))
+	}
+	mux := common.NewMuxSession(common.WrapCompress(acs.Open(), compress), false, conf.MaxStreams)
+	defer mux.Close()
+	quota := quotaKey(user, ses.RemoteAddr())
+	addUserSession(quota, mux)
+	defer delUserSession(quota, mux)
+	for {
+		stream, err := mux.AcceptStream()
+		if err != nil {
+			log.Println("session", ses.RemoteAddr(), err)
+			return
+		}
+		if conf.MaxUserStreams > 0 && userStreams(quota) > conf.MaxUserStreams {
+			log.Println("user", quota, "reached max streams", conf.MaxUserStreams)
+			_ = stream.Reply(common.StatusDenied, "")
+			stream.Close()
+			continue
+		}
+		switch stream.Kind {
+		case common.KindUDP:
+			go common.ServeDatagramStream(conf, stream)
+		case common.KindBind:
+			go common.ServeBindStream(conf, stream)
+		case common.KindListen:
+			go common.ServeListenStream(conf, mux, stream, user)
+		default:
+			go handStream(conf, stream)
+		}
+	}
+}
+
+// quotaKey is what --max-user-streams counts against, clients without a
+// user or client cert are counted per source ip.
+func quotaKey(user string, addr net.Addr) string {
+	if user != "" {
+		return user
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return "ip:" + host
+}
+
+// userStreams counts the open streams of every session of user.
+func userStreams(user string) (n int) {
+	usLock.Lock()
+	defer usLock.Unlock()
+	for _, ses := range userSessions[user] {
+		n += ses.NumStreams()
+	}
+	return
+}
+
+func addUserSession(user string, ses *common.MuxSession) {
+	usLock.Lock()
+	defer usLock.Unlock()
+	userSessions[user] = append(userSessions[user], ses)
+}
+
+func delUserSession(user string, ses *common.MuxSession) {
+	usLock.Lock()
+	defer usLock.Unlock()
+	list := userSessions[user]
+	for i := range list {
+		if list[i] == ses {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(userSessions, user)
+	} else {
+		userSessions[user] = list
+	}
+}
+
+func handStream(conf *common.Config, stream *common.MuxStream) {
+	acs := common.NewACS(stream)
+	defer acs.Close()
+	target := stream.Target
+	log.Println("Target:", target)
+	conn, err := common.DialTarget(conf, target)
 	if err != nil {
 		log.Println(err)
+		_ = stream.Reply(common.StatusOf(err), "")
 		return
 	}
-	target := string(buf)
-	log.Println("Target:", target)
-	conn, err := net.Dial("tcp", target)
+	err = stream.Reply(common.StatusSuccess, conn.LocalAddr().String())
 	if err != nil {
 		log.Println(err)
+		conn.Close()
 		return
 	}
 	cAcs := common.NewACS(conn)
@@ -74,22 +194,110 @@ func handSession(ses net.Conn) {
 	go common.Transfer(acs.Open(), cAcs.Open(), "OUT")
 }
 
-func generateTLSConfig() (*tls.Config, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
+// loadOrGenerateCert keeps the generated server key in --server-key-dir, so
+// clients can pin it across restarts. A key other users could have written
+// or read is refused.
+func loadOrGenerateCert(conf *common.Config) (tls.Certificate, error) {
+	dir, err := serverKeyDir(conf)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certFile := filepath.Join(dir, "tunnel-server.crt")
+	keyFile := filepath.Join(dir, "tunnel-server.key")
+	if err = checkPrivate(keyFile, false); err == nil {
+		xcert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		log.Println("load server certificate", certFile)
+		return xcert, nil
+	} else if !os.IsNotExist(err) {
+		return tls.Certificate{}, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		return nil, err
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: conf.ServerName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
 	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
 	if err != nil {
-		return nil, err
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
 	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	if err = writeKeyFile(keyFile, keyPEM); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Println("generate server certificate", certFile)
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// serverKeyDir returns --server-key-dir, by default go-proxy in the user
+// config dir, created private to this user.
+func serverKeyDir(conf *common.Config) (string, error) {
+	dir := conf.ServerKeyDir
+	if dir == "" {
+		base, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(base, "go-proxy")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, checkPrivate(dir, true)
+}
 
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+// checkPrivate refuses a key file or its dir not owned by this process or
+// open to other users, a dir may be readable by them.
+func checkPrivate(path string, dir bool) error {
+	fi, err := os.Lstat(path)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	mask := os.FileMode(0077)
+	if dir {
+		mask = 0022
+	}
+	switch {
+	case dir && !fi.IsDir():
+		return fmt.Errorf("not a directory:%s", path)
+	case !dir && !fi.Mode().IsRegular():
+		return fmt.Errorf("not a regular file:%s", path)
+	}
+	return checkOwner(path, fi, mask)
+}
+
+// writeKeyFile creates the key file, never reusing one that showed up
+// meanwhile.
+func writeKeyFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
 	}
-	return &tls.Config{Certificates: []tls.Certificate{tlsCert}}, nil
+	return f.Close()
 }
@@ -24,7 +24,8 @@ func skipIDEN(conn io.Reader) error {
 	}
 }
 
-func HandleSocks4(conn io.ReadWriter) (target string, err error) {
+// HandleSocks4 reads a socks4/4a request, the caller answers it with ReplySocks4.
+func HandleSocks4(conn io.ReadWriter) (req *Request, err error) {
 	defer func() {
 		if f, ok := conn.(common.Flusher); ok {
 			f.Flush()
@@ -35,16 +36,21 @@ func HandleSocks4(conn io.ReadWriter) (target string, err error) {
 		return
 	}
 	if ver != SocksVer4 {
-		return "", fmt.Errorf("not supported version:%v", ver)
+		return nil, fmt.Errorf("not supported version:%v", ver)
 	}
 	cmd, err := common.ReadByte(conn)
 	if err != nil {
 		return
 	}
-	if cmd != socksCmdConnect {
-		conn.Write([]byte{SocksVer4, REQUEST_REJECTED, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-		return "", errors.New("not supported command")
+	if common.GetAuthenticator() != nil {
+		ReplySocks4(conn, REQUEST_REJECTED, nil)
+		return nil, errors.New("socks4 not allowed when authentication is required")
 	}
+	if cmd != socksCmdConnect && cmd != socksCmdBind {
+		ReplySocks4(conn, REQUEST_REJECTED, nil)
+		return nil, errors.New("not supported command")
+	}
+	req = &Request{Cmd: cmd}
 	buf := make([]byte, 2)
 	_, err = io.ReadFull(conn, buf)
 	if err != nil {
@@ -65,20 +71,40 @@ func HandleSocks4(conn io.ReadWriter) (target string, err error) {
 		for {
 			b, err := common.ReadByte(conn)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 			if b == 0x00 {
 				break
 			}
 			buf = append(buf, b)
 		}
-		target = net.JoinHostPort(string(buf), strconv.Itoa(int(port)))
+		req.Target = net.JoinHostPort(string(buf), strconv.Itoa(int(port)))
 	} else {
-		target = net.JoinHostPort(net.IP(buf).String(), strconv.Itoa(int(port)))
+		req.Target = net.JoinHostPort(net.IP(buf).String(), strconv.Itoa(int(port)))
 		err = skipIDEN(conn)
 	}
-	if err == nil {
-		_, err = conn.Write([]byte{0x00, 0x5A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	return
+}
+
+// ReplySocks4 answers a socks4 request, addr is the bound address and may be nil.
+func ReplySocks4(conn io.Writer, cd byte, addr net.Addr) (err error) {
+	buf := []byte{0x00, cd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		binary.BigEndian.PutUint16(buf[2:], uint16(ta.Port))
+		if ip4 := ta.IP.To4(); ip4 != nil {
+			copy(buf[4:], ip4)
+		}
+	}
+	_, err = conn.Write(buf)
+	if f, ok := conn.(common.Flusher); ok {
+		f.Flush()
 	}
 	return
 }
+
+func Socks4Reply(err error) byte {
+	if err != nil {
+		return REQUEST_REJECTED
+	}
+	return REQUEST_GRANTED
+}
@@ -1,22 +1,34 @@
 package socks
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/muyuballs/go-proxy/core/common"
 	"io"
 	"net"
-	"strconv"
 )
 
 const (
 	SocksVer5 = 0x05
 
 	socksCmdConnect            = 0x01
+	socksCmdBind               = 0x02
+	socksCmdUDPAssociate       = 0x03
+	repSuccess                 = 0x00
+	repGeneralFailure          = 0x01
+	repNotAllowed              = 0x02
+	repNetUnreachable          = 0x03
+	repHostUnreachable         = 0x04
+	repRefused                 = 0x05
+	repTTLExpired              = 0x06
 	cmdNotSupport              = 0x07
+	addrNotSupport             = 0x08
 	NO_AUTHENTICATION_REQUIRED = 0x00
+	USERNAME_PASSWORD          = 0x02
 	NO_ACCEPTABLE_METHODS      = 0xFF
+	userPassVer                = 0x01
+	userPassSuccess            = 0x00
+	userPassFailure            = 0x01
 	ATYP_IP4                   = 0x01
 	ATYP_DOMAIN                = 0x03
 	ATYP_IP6                   = 0x04
@@ -24,6 +36,7 @@ const (
 
 const (
 	SocksVer4        = 0x04
+	REQUEST_GRANTED  = 0x5A
 	REQUEST_REJECTED = 0x5B
 )
 
@@ -36,7 +49,23 @@ const (
 	          X'FF' NO ACCEPTABLE METHODS
 */
 
-func HandleSocks5(conn io.ReadWriter) (target string, err error) {
+type Request struct {
+	Cmd    byte
+	Target string
+	User   string
+}
+
+func (req *Request) IsUDPAssociate() bool {
+	return req.Cmd == socksCmdUDPAssociate
+}
+
+func (req *Request) IsBind() bool {
+	return req.Cmd == socksCmdBind
+}
+
+// HandleSocks5 negotiates the method and reads the request, the caller
+// answers it with ReplySocks5.
+func HandleSocks5(conn io.ReadWriter) (req *Request, err error) {
 	defer func() {
 		if f, ok := conn.(common.Flusher); ok {
 			f.Flush()
@@ -47,7 +76,7 @@ func HandleSocks5(conn io.ReadWriter) (target string, err error) {
 		return
 	}
 	if ver != SocksVer5 {
-		return "", fmt.Errorf("not supported version:%v", ver)
+		return nil, fmt.Errorf("not supported version:%v", ver)
 	}
 	methodCount, err := common.ReadByte(conn)
 	if err != nil {
@@ -58,82 +87,152 @@ func HandleSocks5(conn io.ReadWriter) (target string, err error) {
 	if err != nil {
 		return
 	}
-	var hasNAQ bool = false
+	method := byte(NO_AUTHENTICATION_REQUIRED)
+	if common.GetAuthenticator() != nil {
+		method = USERNAME_PASSWORD
+	}
+	var accepted bool = false
 	for _, n := range methods {
-		hasNAQ = n == 0x00
-		if hasNAQ {
+		accepted = n == method
+		if accepted {
 			break
 		}
 	}
-	if hasNAQ {
-		//SELECTED NO AUTHENTICATION REQUIRED
-		conn.Write([]byte{SocksVer5, NO_AUTHENTICATION_REQUIRED})
-	} else {
+	if !accepted {
 		conn.Write([]byte{SocksVer5, NO_ACCEPTABLE_METHODS})
-		return "", errors.New("client not support NAQ")
+		return nil, fmt.Errorf("client not support method:%v", method)
 	}
+	conn.Write([]byte{SocksVer5, method})
 	if f, ok := conn.(common.Flusher); ok {
 		f.Flush()
 	}
+	req = &Request{}
+	if method == USERNAME_PASSWORD {
+		req.User, err = authUserPass(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
 	ver, err = common.ReadByte(conn)
 	if err != nil {
 		return
 	}
 	if ver != SocksVer5 {
-		return "", errors.New("socks ver must to be 0x05")
+		return nil, errors.New("socks ver must to be 0x05")
 	}
 	cmd, err := common.ReadByte(conn)
 	if err != nil {
 		return
 	}
-	if cmd != socksCmdConnect {
-		conn.Write([]byte{SocksVer5, cmdNotSupport})
-		return "", errors.New("not supported command")
+	if cmd != socksCmdConnect && cmd != socksCmdBind && cmd != socksCmdUDPAssociate {
+		ReplySocks5(conn, cmdNotSupport, nil)
+		return nil, errors.New("not supported command")
 	}
+	req.Cmd = cmd
 	_, err = common.ReadByte(conn) //skip RSV byte
 	if err != nil {
 		return
 	}
-	atyp, err := common.ReadByte(conn)
+	req.Target, err = common.ReadAddr(conn)
+	if err != nil {
+		ReplySocks5(conn, addrNotSupport, nil)
+		return nil, err
+	}
+	return
+}
+
+/*
+	+----+------+----------+------+----------+
+	|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	+----+------+----------+------+----------+
+	| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	+----+------+----------+------+----------+
+*/
+
+func authUserPass(conn io.ReadWriter) (user string, err error) {
+	ver, err := common.ReadByte(conn)
 	if err != nil {
 		return
 	}
-	var host string
-	var port uint16
-	if atyp == ATYP_IP4 {
-		buf := make([]byte, net.IPv4len+2)
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			return
-		}
-		host = net.IP(buf[:net.IPv4len]).String()
-		port = binary.BigEndian.Uint16(buf[net.IPv4len:])
-	} else if atyp == ATYP_IP6 {
-		buf := make([]byte, net.IPv6len+2)
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			return
-		}
-		host = net.IP(buf[:net.IPv6len]).String()
-		port = binary.BigEndian.Uint16(buf[net.IPv6len:])
-	} else if atyp == ATYP_DOMAIN {
-		domainLength, err := common.ReadByte(conn)
-		if err != nil {
-			return "", err
-		}
-		buf := make([]byte, domainLength+2)
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			return "", err
-		}
-		host = string(buf[0:domainLength])
-		port = binary.BigEndian.Uint16(buf[domainLength:])
-	} else {
-		return "", errors.New("not supported address type")
+	if ver != userPassVer {
+		return "", fmt.Errorf("not supported username/password version:%v", ver)
 	}
-	target = net.JoinHostPort(host, strconv.Itoa(int(port)))
-	if err == nil {
-		_, err = conn.Write([]byte{SocksVer5, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00})
+	ulen, err := common.ReadByte(conn)
+	if err != nil {
+		return
+	}
+	uname := make([]byte, ulen)
+	_, err = io.ReadFull(conn, uname)
+	if err != nil {
+		return
+	}
+	plen, err := common.ReadByte(conn)
+	if err != nil {
+		return
+	}
+	passwd := make([]byte, plen)
+	_, err = io.ReadFull(conn, passwd)
+	if err != nil {
+		return
+	}
+	if !common.CheckUser(string(uname), string(passwd)) {
+		conn.Write([]byte{userPassVer, userPassFailure})
+		return "", fmt.Errorf("socks5 authentication failed for user:%s", uname)
+	}
+	_, err = conn.Write([]byte{userPassVer, userPassSuccess})
+	if f, ok := conn.(common.Flusher); ok {
+		f.Flush()
+	}
+	return string(uname), err
+}
+
+// ReplySocks5 answers the request read by HandleSocks5, addr is the bound
+// address and may be nil.
+func ReplySocks5(conn io.Writer, rep byte, addr net.Addr) (err error) {
+	buf := []byte{SocksVer5, rep, 0x00}
+	buf = appendNetAddr(buf, addr)
+	_, err = conn.Write(buf)
+	if f, ok := conn.(common.Flusher); ok {
+		f.Flush()
 	}
 	return
 }
+
+func appendNetAddr(buf []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, ATYP_IP4)
+		buf = append(buf, ip4...)
+	} else if len(ip) == net.IPv6len {
+		buf = append(buf, ATYP_IP6)
+		buf = append(buf, ip...)
+	} else {
+		buf = append(buf, ATYP_IP4, 0x00, 0x00, 0x00, 0x00)
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
+func Socks5Rep(err error) byte {
+	switch common.StatusOf(err) {
+	case common.StatusSuccess:
+		return repSuccess
+	case common.StatusDenied:
+		return repNotAllowed
+	case common.StatusNetUnreachable:
+		return repNetUnreachable
+	case common.StatusHostUnreachable, common.StatusDNSFailure:
+		return repHostUnreachable
+	case common.StatusRefused:
+		return repRefused
+	case common.StatusTimeout:
+		return repTTLExpired
+	}
+	return repGeneralFailure
+}
@@ -0,0 +1,43 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/muyuballs/go-proxy/core/common"
+)
+
+/*
+	+----+------+------+----------+----------+----------+
+	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+	+----+------+------+----------+----------+----------+
+	| 2  |  1   |  1   | Variable |    2     | Variable |
+	+----+------+------+----------+----------+----------+
+*/
+
+var ErrUDPFragment = errors.New("socks5 udp fragment not supported")
+
+// ParseUDPHeader splits a client datagram into destination and payload.
+func ParseUDPHeader(packet []byte) (target string, data []byte, err error) {
+	if len(packet) < 4 {
+		return "", nil, errors.New("socks5 udp packet too short")
+	}
+	if packet[2] != 0x00 {
+		return "", nil, ErrUDPFragment
+	}
+	r := bytes.NewReader(packet[3:])
+	target, err = common.ReadAddr(r)
+	if err != nil {
+		return
+	}
+	return target, packet[len(packet)-r.Len():], nil
+}
+
+// BuildUDPHeader prepends the socks5 udp header for a datagram from addr.
+func BuildUDPHeader(addr string, data []byte) ([]byte, error) {
+	buf, err := common.AppendAddr([]byte{0x00, 0x00, 0x00}, addr)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, data...), nil
+}
@@ -1,13 +1,17 @@
 module github.com/muyuballs/go-proxy
 
 require (
+	github.com/andybalholm/brotli v1.0.2
 	github.com/boltdb/bolt v1.3.1 // indirect
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/google/easypki v1.1.0
+	github.com/gorilla/websocket v1.4.1
 	github.com/hashicorp/golang-lru v0.5.0
 	github.com/klauspost/compress v1.4.1 // indirect
+	github.com/oschwald/maxminddb-golang v1.3.1
 	github.com/urfave/cli v1.20.0
 	github.com/valyala/fasthttp v1.1.0
-	golang.org/x/sys v0.0.0-20190109145017-48ac38b7c8cb // indirect
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
 	gopkg.in/google/easypki.v1 v1.1.0
 )